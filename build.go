@@ -2,22 +2,26 @@ package main
 
 import (
 	"context"
+	"crypto/sha256"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
+	"regexp"
 	"strings"
 
 	cpy "github.com/otiai10/copy"
 
 	"github.com/pkg/errors"
 	apiv1 "k8s.io/api/core/v1"
-	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
+// imageDigestRegexp matches the digest of an image in a package of type k8s
+var imageDigestRegexp = regexp.MustCompile(`^sha256:[0-9a-f]{64}$`) // nolint:gochecknoglobals
+
 // Build builds a chaincode on Kubernetes
 func Build(ctx context.Context, cfg Config) error {
 	log.Println("Procedure: build")
@@ -35,66 +39,362 @@ func Build(ctx context.Context, cfg Config) error {
 	if err != nil {
 		return errors.Wrap(err, "getting metadata for chaincode")
 	}
+
+	// Apply per chaincode configuration
+	cfg, err = cfg.ForChaincode(metadata.Label, getPeerMSPID())
+	if err != nil {
+		return errors.Wrap(err, "applying overrides")
+	}
 	metadata.Label = strings.ToLower(metadata.Label)
 
+	// The builder pods may run in another namespace or cluster
+	cfg, err = cfg.ForBuilder()
+	if err != nil {
+		return errors.Wrap(err, "getting target of builder pods")
+	}
+
+	// Identify the chaincode and its source for the labels and annotations of the builder pod
+	metadata.CCID, err = getCCIDFromBuildDir(sourceDir)
+	if err != nil {
+		log.Printf("Chaincode ID of %s not available: %s", metadata.Label, err)
+	}
+	metadata.SourceHash, err = hashSource(sourceDir)
+	if err != nil {
+		return errors.Wrap(err, "hashing chaincode source")
+	}
+	metadata.PackageHash = getPackageHash(metadata)
+
+	// Packages with a prebuilt image are not built on Kubernetes
+	if IsPrebuiltImage(metadata.Type) {
+		return buildPrebuiltImage(sourceDir, outputDir, metadata)
+	}
+
+	// Build chaincode in a builder pod or use a cached build
+	image, err := buildCached(ctx, cfg, metadata, sourceDir, outputDir)
+	if err != nil {
+		return err
+	}
+
+	// Copy META-INF, if available
+	sourceMeta := filepath.Join(sourceDir, "META-INF")
+	if _, err := os.Stat(sourceMeta); !os.IsNotExist(err) {
+		err = cpy.Copy(sourceMeta, outputDir)
+		if err != nil {
+			return errors.Wrap(err, "copy META-INF to output dir")
+		}
+	}
+
+	// Create build information
+	buildInformation := BuildInformation{
+		Image:      image,
+		Platform:   metadata.Type,
+		SourceHash: metadata.SourceHash,
+	}
+
+	return writeBuildInformation(outputDir, &buildInformation)
+}
+
+// getPackageHash returns the hash of the whole chaincode package, which is part of the chaincode ID.
+// If the build context does not contain the chaincode ID, the hash is calculated from the metadata and the source.
+func getPackageHash(metadata *ChaincodeMetadata) string {
+	parts := strings.SplitN(metadata.CCID, ":", 2)
+	if len(parts) == 2 && len(parts[1]) >= 2*nameHashLength {
+		return parts[1]
+	}
+
+	h := sha256.New()
+	fmt.Fprintf(h, "metadata:%s\nsource:%s\n", metadata.MetadataID, metadata.SourceHash)
+
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// buildCached restores the build output from the build cache. On a cache miss, the chaincode is built
+// in a builder pod and its output is added to the cache.
+// Concurrent builds of the same package are coordinated with a Lease: the later builds wait for the first one
+// and reuse its output from the cache or, if the cache is disabled, from the shared builds on the transfer volume.
+func buildCached(ctx context.Context,
+	cfg Config, metadata *ChaincodeMetadata, sourceDir, outputDir string) (string, error) {
+	cache, err := newBuildCache(cfg)
+	if err != nil {
+		return "", errors.Wrap(err, "opening build cache")
+	}
+	if cache == nil {
+		cache, err = newSharedBuilds(cfg)
+		if err != nil {
+			return "", errors.Wrap(err, "opening shared builds")
+		}
+	}
+
+	image := cfg.Images[metadata.Type]
+	key := ""
+	restore := func() bool {
+		if cache == nil {
+			return false
+		}
+		hit, err := cache.Restore(key, outputDir)
+		if err != nil {
+			log.Printf("Restoring build of chaincode %s from cache failed, building it: %s", metadata.Label, err)
+		}
+		if hit {
+			log.Printf("Using cached build %s for chaincode %s", key, metadata.Label)
+		}
+		return hit
+	}
+	if cache != nil {
+		key, err = cache.Key(cfg, metadata)
+		if err != nil {
+			return "", errors.Wrap(err, "getting build cache key")
+		}
+	}
+	if restore() {
+		return image, nil
+	}
+
+	lock, err := newLease(cfg, getBuildLeaseName(metadata), map[string]string{
+		"app.kubernetes.io/managed-by":     "hlfabric-k8scc",
+		leaseKindLabel:                     leaseKindBuild,
+		metadataPrefix + "chaincode-label": sanitizeLabelValue(metadata.Label),
+	})
+	if err != nil {
+		return "", errors.Wrap(err, "creating build lease")
+	}
+	acquired, _, err := lock.tryAcquire(ctx)
+	if err != nil {
+		log.Printf("Acquiring lease %s: %s", lock.name, err)
+	}
+	if !acquired {
+		// The running build shares its output with the waiting builds
+		if cache != nil {
+			if err := cache.AddWaiter(key); err != nil {
+				log.Printf("Waiting for the build of chaincode %s without sharing its output: %s", metadata.Label, err)
+			}
+		}
+		err = lock.acquire(ctx, "build of chaincode "+metadata.Label)
+		if err != nil {
+			return "", errors.Wrap(err, "waiting for concurrent build")
+		}
+	}
+	defer lock.release()
+
+	// The build stops, if the lease gets lost, as another build may take it over
+	ctx, cancel := lock.context(ctx)
+	defer cancel()
+	leases := []*lease{lock}
+
+	// The build, which held the lease before, may have stored its output in the meantime
+	if restore() {
+		return image, nil
+	}
+
+	// Wait for a free slot, if the number of builder pods is limited
+	if cfg.Builder.MaxConcurrent > 0 {
+		slot, err := acquireBuilderSlot(ctx, cfg, metadata.Label)
+		if err != nil {
+			return "", errors.Wrap(err, "waiting for a builder slot")
+		}
+		defer slot.release()
+
+		var cancelSlot context.CancelFunc
+		ctx, cancelSlot = slot.context(ctx)
+		defer cancelSlot()
+		leases = append(leases, slot)
+	}
+
+	image, err = buildInPod(ctx, cfg, metadata, sourceDir, outputDir)
+	for _, l := range leases {
+		if l.isLost() {
+			return "", errors.Wrapf(errLeaseLost, "build of chaincode %s stopped, lease %s", metadata.Label, l.name)
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if cache != nil {
+		err = cache.Store(key, outputDir)
+		if err != nil {
+			log.Printf("Storing build of chaincode %s in cache: %s", metadata.Label, err)
+		}
+	}
+
+	return image, nil
+}
+
+// buildInPod builds the chaincode in a builder pod
+func buildInPod(ctx context.Context,
+	cfg Config, metadata *ChaincodeMetadata, sourceDir, outputDir string) (string, error) {
+	switch cfg.Builder.Kind {
+	case "", BuilderKindPod:
+	case BuilderKindJob:
+		if cfg.Transfer.Mode == TransferModeExec {
+			return "", errors.New("builder kind job requires the transfer mode pv")
+		}
+	default:
+		return "", fmt.Errorf("unknown builder kind %q", cfg.Builder.Kind)
+	}
+
+	if cfg.Transfer.Mode == TransferModeExec {
+		return buildWithExecTransfer(ctx, cfg, metadata, sourceDir, outputDir)
+	}
+
+	return buildWithPVTransfer(ctx, cfg, metadata, sourceDir, outputDir)
+}
+
+// buildWithPVTransfer builds the chaincode in a pod, which gets the data using the transfer PV
+func buildWithPVTransfer(ctx context.Context,
+	cfg Config, metadata *ChaincodeMetadata, sourceDir, outputDir string) (string, error) {
 	// Create transfer directory
 	copyOpts := cpy.Options{AddPermission: os.ModePerm}
 
 	prefix, _ := os.Hostname()
 	transferdir, err := ioutil.TempDir(cfg.TransferVolume.Path, prefix)
 	if err != nil {
-		return errors.Wrap(err, fmt.Sprintf("creating directory %s on transfer volume", cfg.TransferVolume.Path))
+		return "", errors.Wrap(err, fmt.Sprintf("creating directory %s on transfer volume", cfg.TransferVolume.Path))
 	}
 	defer os.RemoveAll(transferdir) // Cleanup transfer directory when this process ends
 
 	// Setup transfer
 	transferSrc := filepath.Join(transferdir, "src")
-	transferSrcMeta := filepath.Join(sourceDir, "META-INF")
 	transferBld := filepath.Join(transferdir, "bld")
-	buildInfoFile := filepath.Join(outputDir, "k8scc_buildinfo.json")
 
 	// Copy source
 	err = cpy.Copy(sourceDir, transferSrc, copyOpts)
 	if err != nil {
-		return errors.Wrap(err, "copy source dir in the transfer dir")
+		return "", errors.Wrap(err, "copy source dir in the transfer dir")
 	}
 
 	// Create output directory
 	err = os.Mkdir(transferBld, os.ModePerm)
 	if err != nil {
-		return errors.Wrap(err, "create output dir in the transfer dir")
+		return "", errors.Wrap(err, "create output dir in the transfer dir")
 	}
 	err = os.Chmod(transferBld, os.ModePerm)
 	if err != nil {
-		return errors.Wrap(err, "chmod on output dir in the transfer dir")
+		return "", errors.Wrap(err, "chmod on output dir in the transfer dir")
+	}
+
+	// Build in a builder Pod or Job
+	var image string
+	if cfg.Builder.Kind == BuilderKindJob {
+		image, err = runBuilderJob(ctx, cfg, metadata, filepath.Base(transferdir))
+	} else {
+		image, err = runBuilderPod(ctx, cfg, metadata, filepath.Base(transferdir))
+	}
+	if err != nil {
+		return "", err
+	}
+
+	// Copy data from transfer pv to original output destination
+	err = cpy.Copy(transferBld, outputDir)
+	if err != nil {
+		return "", errors.Wrap(err, "copy build artifacts from transfer")
 	}
 
+	return image, nil
+}
+
+// runBuilderPod builds the chaincode in a bare Pod and returns the builder image
+func runBuilderPod(ctx context.Context, cfg Config, metadata *ChaincodeMetadata, transferPVPrefix string) (string, error) {
 	// Create builder Pod
-	pod, err := createBuilderPod(ctx, cfg, metadata, filepath.Base(transferdir))
+	pod, err := createBuilderPod(ctx, cfg, metadata, transferPVPrefix)
 	if err != nil {
-		return errors.Wrap(err, "creating builder pod")
+		return "", errors.Wrap(err, "creating builder pod")
 	}
-	defer cleanupPodSilent(pod)
+	defer cleanupPodSilent(cfg, pod)
 
 	// Watch builder Pod for completion or failure
-	podSucceeded, err := watchPodUntilCompletion(ctx, pod)
+	err = watchPodUntilCompletion(ctx, cfg, pod)
 	if err != nil {
-		return errors.Wrap(err, "watching builder pod")
+		return "", errors.Wrapf(err, "build of Chaincode %s in Pod %s failed", metadata.Label, pod.Name)
 	}
 
-	if !podSucceeded {
-		return fmt.Errorf("build of Chaincode %s in Pod %s failed", metadata.Label, pod.Name)
+	return pod.Spec.Containers[0].Image, nil
+}
+
+// buildWithExecTransfer builds the chaincode in a pod, which gets the data using exec
+func buildWithExecTransfer(ctx context.Context,
+	cfg Config, metadata *ChaincodeMetadata, sourceDir, outputDir string) (string, error) {
+	// Create builder Pod
+	pod, err := createBuilderPod(ctx, cfg, metadata, "transfer")
+	if err != nil {
+		return "", errors.Wrap(err, "creating builder pod")
 	}
+	defer cleanupPodSilent(cfg, pod)
 
-	// Copy data from transfer pv to original output destination
-	err = cpy.Copy(transferBld, outputDir)
+	// Watch builder Pod for completion or failure, while the data is transferred
+	watched := watchPodInBackground(ctx, cfg, pod)
+
+	// Copy source into the pod
+	err = waitForContainerRunning(ctx, cfg, pod, transferContainerName)
+	if err != nil {
+		return "", errors.Wrap(err, "waiting for transfer container")
+	}
+
+	err = copyToPod(ctx, cfg, pod, transferContainerName, sourceDir, "/chaincode/input/")
 	if err != nil {
-		return errors.Wrap(err, "copy build artifacts from transfer")
+		return "", errors.Wrap(err, "copy source dir into builder pod")
+	}
+
+	err = touchInPod(ctx, cfg, pod, transferContainerName, transferReadyFile)
+	if err != nil {
+		return "", errors.Wrap(err, "starting build")
+	}
+
+	// Copy build output from the pod
+	err = waitForContainerRunning(ctx, cfg, pod, "builder")
+	if err != nil {
+		return "", errors.Wrap(err, "waiting for builder container")
+	}
+
+	exitCode, err := waitForExitCode(ctx, cfg, pod, "builder")
+	if err != nil {
+		return "", errors.Wrap(err, "waiting for build")
+	}
+
+	if exitCode == "0" {
+		err = copyFromPod(ctx, cfg, pod, "builder", "/chaincode/output/", outputDir)
+		if err != nil {
+			return "", errors.Wrap(err, "copy build artifacts from builder pod")
+		}
+	}
+
+	err = touchInPod(ctx, cfg, pod, "builder", transferFetchedFile)
+	if err != nil {
+		return "", errors.Wrap(err, "finishing build")
+	}
+
+	err = <-watched
+	if err != nil {
+		return "", errors.Wrapf(err, "build of Chaincode %s in Pod %s failed", metadata.Label, pod.Name)
+	}
+
+	return pod.Spec.Containers[0].Image, nil
+}
+
+// ChaincodeImage is the content of image.json in packages of type k8s
+type ChaincodeImage struct {
+	Name   string `json:"name"`
+	Digest string `json:"digest"`
+}
+
+// Reference returns the image reference pinned to the digest
+func (i *ChaincodeImage) Reference() string {
+	return fmt.Sprintf("%s@%s", i.Name, i.Digest)
+}
+
+// buildPrebuiltImage skips the builder pod and references the image of the package in the build information
+func buildPrebuiltImage(sourceDir, outputDir string, metadata *ChaincodeMetadata) error {
+	log.Printf("Chaincode %s references a prebuilt image, skipping build", metadata.Label)
+
+	image, err := getChaincodeImage(sourceDir)
+	if err != nil {
+		return errors.Wrap(err, "getting chaincode image")
 	}
 
 	// Copy META-INF, if available
-	if _, err := os.Stat(transferSrcMeta); !os.IsNotExist(err) {
-		err = cpy.Copy(transferSrcMeta, outputDir)
+	sourceMeta := filepath.Join(sourceDir, "META-INF")
+	if _, err := os.Stat(sourceMeta); !os.IsNotExist(err) {
+		err = cpy.Copy(sourceMeta, outputDir)
 		if err != nil {
 			return errors.Wrap(err, "copy META-INF to output dir")
 		}
@@ -102,10 +402,39 @@ func Build(ctx context.Context, cfg Config) error {
 
 	// Create build information
 	buildInformation := BuildInformation{
-		Image:    pod.Spec.Containers[0].Image,
-		Platform: metadata.Type,
+		Image:      image.Reference(),
+		Platform:   metadata.Type,
+		SourceHash: metadata.SourceHash,
+	}
+
+	return writeBuildInformation(outputDir, &buildInformation)
+}
+
+func getChaincodeImage(sourceDir string) (*ChaincodeImage, error) {
+	imageData, err := ioutil.ReadFile(filepath.Join(sourceDir, "image.json"))
+	if err != nil {
+		return nil, errors.Wrap(err, "Reading image.json")
+	}
+
+	image := ChaincodeImage{}
+	err = json.Unmarshal(imageData, &image)
+	if err != nil {
+		return nil, errors.Wrap(err, "Unmarshaling image.json")
+	}
+
+	if image.Name == "" {
+		return nil, errors.New("No image name found in image.json")
+	}
+	if !imageDigestRegexp.MatchString(image.Digest) {
+		return nil, fmt.Errorf("invalid image digest %q in image.json", image.Digest)
 	}
 
+	return &image, nil
+}
+
+func writeBuildInformation(outputDir string, buildInformation *BuildInformation) error {
+	buildInfoFile := filepath.Join(outputDir, "k8scc_buildinfo.json")
+
 	bi, err := json.Marshal(buildInformation)
 	if err != nil {
 		return errors.Wrap(err, "marshaling BuildInformation")
@@ -127,11 +456,26 @@ func Build(ctx context.Context, cfg Config) error {
 func createBuilderPod(ctx context.Context,
 	cfg Config, metadata *ChaincodeMetadata, transferPVPrefix string) (*apiv1.Pod, error) {
 	// Setup kubernetes client
-	clientset, err := getKubernetesClientset()
+	clientset, err := getKubernetesClientset(cfg)
 	if err != nil {
 		return nil, errors.Wrap(err, "getting kubernetes clientset")
 	}
 
+	peer, err := getPeerPod(ctx, cfg)
+	if err != nil {
+		return nil, errors.Wrap(err, "getting myself Pod")
+	}
+
+	pod, err := newBuilderPod(cfg, metadata, transferPVPrefix, peer)
+	if err != nil {
+		return nil, err
+	}
+
+	return clientset.CoreV1().Pods(cfg.Namespace).Create(ctx, pod, metav1.CreateOptions{})
+}
+
+// newBuilderPod returns the builder pod owned by the peer pod, which is used as is or as template of a builder job
+func newBuilderPod(cfg Config, metadata *ChaincodeMetadata, transferPVPrefix string, peer *apiv1.Pod) (*apiv1.Pod, error) {
 	// Get builder image
 	image, ok := cfg.Images[metadata.Type]
 	if !ok {
@@ -157,40 +501,39 @@ func createBuilderPod(ctx context.Context,
 			Value: s[1],
 		})
 	}
+	envvars = append(envvars, cfg.Builder.EnvVars()...)
 
-	// Get peer Pod
-	myself, _ := os.Hostname()
-	myselfPod, err := clientset.CoreV1().Pods(cfg.Namespace).Get(ctx, myself, metav1.GetOptions{})
+	// Set resources
+	limits, err := cfg.Builder.Resources.Limits()
 	if err != nil {
-		return nil, errors.Wrap(err, "getting myself Pod")
+		return nil, errors.Wrap(err, "getting builder resources")
 	}
 
-	// Set resources
-	limits := apiv1.ResourceList{}
-	if limit := cfg.Builder.Resources.LimitMemory; limit != "" {
-		limits["memory"] = resource.MustParse(limit)
+	// Pod
+	podname, err := getBuilderPodName(cfg, peer.Name, metadata)
+	if err != nil {
+		return nil, errors.Wrap(err, "getting builder pod name")
 	}
-	if limit := cfg.Builder.Resources.LimitCPU; limit != "" {
-		limits["cpu"] = resource.MustParse(limit)
+	info := ChaincodeInfo{
+		Component:     ComponentBuilder,
+		Instance:      podname,
+		CCID:          metadata.CCID,
+		Label:         metadata.Label,
+		MSPID:         getPeerMSPID(),
+		Peer:          peer.Name,
+		PeerNamespace: peer.Namespace,
+		PeerUID:       string(peer.UID),
+		Platform:      metadata.Type,
+		Image:         image,
+		SourceHash:    metadata.SourceHash,
+		BuildLease:    getBuildLeaseName(metadata),
 	}
-
-	// Pod
-	podname := fmt.Sprintf("%s-ccbuild-%s", myself, metadata.MetadataID)
 	pod := &apiv1.Pod{
 		ObjectMeta: metav1.ObjectMeta{
-			Name: podname,
-			OwnerReferences: []metav1.OwnerReference{
-				{
-					APIVersion:         "v1",
-					Kind:               "Pod",
-					Name:               myselfPod.Name,
-					UID:                myselfPod.UID,
-					BlockOwnerDeletion: BoolRef(true),
-				},
-			},
-			Labels: map[string]string{
-				"externalcc-type": "builder",
-			},
+			Name:            podname,
+			OwnerReferences: getPeerOwnerReferences(cfg, peer),
+			Labels:          info.Labels(cfg.Builder.Labels),
+			Annotations:     info.Annotations(cfg.Builder.Annotations),
 		},
 		Spec: apiv1.PodSpec{
 			Containers: []apiv1.Container{
@@ -234,5 +577,16 @@ func createBuilderPod(ctx context.Context,
 		},
 	}
 
-	return clientset.CoreV1().Pods(cfg.Namespace).Create(ctx, pod, metav1.CreateOptions{})
+	// Transfer data using exec instead of the transfer PV
+	if cfg.Transfer.Mode == TransferModeExec {
+		useExecTransfer(cfg, &pod.Spec, true)
+	}
+
+	// Customize pod
+	err = applyPodTemplate(cfg.Builder.PodTemplate, pod)
+	if err != nil {
+		return nil, errors.Wrap(err, "applying builder pod template")
+	}
+
+	return pod, nil
 }
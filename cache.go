@@ -0,0 +1,348 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	cpy "github.com/otiai10/copy"
+	"github.com/pkg/errors"
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// sharedBuildAge is how long the output of a build is shared with the concurrent builds of the same package,
+// if the build cache is disabled
+const sharedBuildAge = time.Hour
+
+// buildCache stores build outputs on the transfer volume, so builds of the same
+// chaincode package are shared between all peers
+type buildCache struct {
+	dir        string
+	maxSize    int64         // bytes, 0 is unlimited
+	maxEntries int           // 0 is unlimited
+	maxAge     time.Duration // since the build, 0 is unlimited
+
+	waitersOnly bool // stores only the outputs, which another build waits for
+}
+
+// buildCacheEntry is a cached build output used for the eviction
+type buildCacheEntry struct {
+	path    string
+	size    int64
+	lastUse time.Time
+}
+
+// newBuildCache returns the build cache or nil, if the cache is disabled
+func newBuildCache(cfg Config) (*buildCache, error) {
+	if !cfg.Builder.Cache.Enabled {
+		return nil, nil
+	}
+
+	c := &buildCache{
+		dir:        cfg.Builder.Cache.Path,
+		maxEntries: cfg.Builder.Cache.MaxEntries,
+	}
+	if c.dir == "" {
+		c.dir = filepath.Join(cfg.TransferVolume.Path, "cache")
+	}
+
+	if cfg.Builder.Cache.MaxSize != "" {
+		maxSize, err := resource.ParseQuantity(cfg.Builder.Cache.MaxSize)
+		if err != nil {
+			return nil, errors.Wrap(err, "parsing max_size of build cache")
+		}
+		c.maxSize = maxSize.Value()
+	}
+
+	err := os.MkdirAll(c.dir, os.ModePerm)
+	if err != nil {
+		return nil, errors.Wrap(err, "creating build cache dir")
+	}
+
+	return c, nil
+}
+
+// newSharedBuilds returns the directory builds/ on the transfer volume, which shares the output of a build with the
+// concurrent builds of the same package, if the build cache is disabled. It returns nil in the transfer mode exec.
+func newSharedBuilds(cfg Config) (*buildCache, error) {
+	if cfg.Transfer.Mode == TransferModeExec || cfg.TransferVolume.Path == "" {
+		return nil, nil
+	}
+
+	c := &buildCache{
+		dir:         filepath.Join(cfg.TransferVolume.Path, "builds"),
+		maxAge:      sharedBuildAge,
+		waitersOnly: true,
+	}
+
+	err := os.MkdirAll(c.dir, os.ModePerm)
+	if err != nil {
+		return nil, errors.Wrap(err, "creating shared builds dir")
+	}
+
+	return c, nil
+}
+
+// Key returns the hash of the chaincode source, the platform and the builder pod, e.g. its image, environment,
+// command, resources and pod template, which may differ per chaincode with overrides
+func (c *buildCache) Key(cfg Config, metadata *ChaincodeMetadata) (string, error) {
+	// The transfer and the peer differ with every build and are not part of the key
+	pod, err := newBuilderPod(cfg, metadata, "cache", &apiv1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "cache"}})
+	if err != nil {
+		return "", errors.Wrap(err, "getting builder pod")
+	}
+	spec := pod.Spec.DeepCopy()
+	spec.Volumes = nil
+	spec.InitContainers = nil
+	for i := range spec.Containers {
+		spec.Containers[i].VolumeMounts = nil
+	}
+
+	h := sha256.New()
+	fmt.Fprintf(h, "platform:%s\npath:%s\nsource:%s\nbuilder:", metadata.Type, metadata.Path, metadata.SourceHash)
+	err = json.NewEncoder(h).Encode(spec)
+	if err != nil {
+		return "", errors.Wrap(err, "hashing builder pod")
+	}
+
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// hashSource returns the hash of all files in the source directory including their paths and modes
+func hashSource(sourceDir string) (string, error) {
+	h := sha256.New()
+
+	// filepath.Walk walks in lexical order, so the hash is deterministic
+	err := filepath.Walk(sourceDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(sourceDir, path)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(h, "%s:%s\n", filepath.ToSlash(rel), info.Mode())
+
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(h, "link:%s\n", link)
+		case info.Mode().IsRegular():
+			f, err := os.Open(path) // #nosec G304
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+
+			_, err = io.Copy(h, f)
+			return err
+		}
+
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// Restore copies the cached build output into outputDir and returns false on a cache miss
+func (c *buildCache) Restore(key, outputDir string) (bool, error) {
+	entry := filepath.Join(c.dir, key)
+	info, err := os.Stat(entry)
+	if os.IsNotExist(err) || (err == nil && c.isExpired(info)) {
+		return false, nil
+	}
+
+	err = cpy.Copy(filepath.Join(entry, "output"), outputDir)
+	if err != nil {
+		// The chaincode is built afterwards, which must not mix its output with a partial copy
+		if clearErr := clearDir(outputDir); clearErr != nil {
+			log.Printf("Clearing output dir after failed restore: %s", clearErr)
+		}
+		return false, errors.Wrap(err, "copy build output from cache")
+	}
+
+	// Mark entry as recently used, entries with a max age expire after the build nevertheless
+	if c.maxAge == 0 {
+		now := time.Now()
+		err = os.Chtimes(entry, now, now)
+		if err != nil {
+			log.Printf("Updating last use of cache entry %s: %s", key, err)
+		}
+	}
+
+	return true, nil
+}
+
+// AddWaiter marks the key as waited for by a concurrent build, which reuses the output after the running build
+func (c *buildCache) AddWaiter(key string) error {
+	if !c.waitersOnly {
+		return nil
+	}
+
+	return os.MkdirAll(c.waiterPath(key), os.ModePerm)
+}
+
+// waiterPath returns the marker directory of the builds waiting for the key
+func (c *buildCache) waiterPath(key string) string {
+	return filepath.Join(c.dir, key+".waiting")
+}
+
+// Store adds the build output in outputDir atomically to the cache and evicts old entries afterwards.
+// The shared builds store the output only, if another build waits for it.
+func (c *buildCache) Store(key, outputDir string) error {
+	if c.waitersOnly {
+		if _, err := os.Stat(c.waiterPath(key)); os.IsNotExist(err) {
+			return nil
+		}
+		defer os.RemoveAll(c.waiterPath(key)) // The waiters restore the stored entry
+	}
+
+	tmpEntry, err := ioutil.TempDir(c.dir, ".tmp-")
+	if err != nil {
+		return errors.Wrap(err, "creating temporary cache entry")
+	}
+	defer os.RemoveAll(tmpEntry) // Cleanup, if the entry was not moved
+
+	err = os.Chmod(tmpEntry, os.ModePerm)
+	if err != nil {
+		return errors.Wrap(err, "chmod on temporary cache entry")
+	}
+
+	err = cpy.Copy(outputDir, filepath.Join(tmpEntry, "output"), cpy.Options{AddPermission: os.ModePerm})
+	if err != nil {
+		return errors.Wrap(err, "copy build output to cache")
+	}
+
+	// An expired entry is replaced
+	entry := filepath.Join(c.dir, key)
+	if info, statErr := os.Stat(entry); statErr == nil && c.isExpired(info) {
+		err = os.RemoveAll(entry)
+		if err != nil {
+			return errors.Wrap(err, "removing expired cache entry")
+		}
+	}
+
+	// Another peer may have stored the same build in the meantime, we keep the existing entry
+	err = os.Rename(tmpEntry, entry)
+	if err != nil {
+		if _, statErr := os.Stat(entry); statErr == nil {
+			return nil
+		}
+		return errors.Wrap(err, "moving cache entry")
+	}
+
+	return c.evict()
+}
+
+// isExpired returns true, if the entry is older than the max age
+func (c *buildCache) isExpired(info os.FileInfo) bool {
+	return c.maxAge > 0 && time.Since(info.ModTime()) >= c.maxAge
+}
+
+// evict removes the least recently used entries until the cache is within its limits
+func (c *buildCache) evict() error {
+	if c.maxSize == 0 && c.maxEntries == 0 && c.maxAge == 0 {
+		return nil
+	}
+
+	files, err := ioutil.ReadDir(c.dir)
+	if err != nil {
+		return errors.Wrap(err, "listing build cache")
+	}
+
+	entries := []buildCacheEntry{}
+	total := int64(0)
+	for _, f := range files {
+		if !f.IsDir() || strings.HasPrefix(f.Name(), ".") {
+			continue // skip temporary entries
+		}
+		if c.isExpired(f) {
+			log.Printf("Removing expired build %s", f.Name())
+			err = os.RemoveAll(filepath.Join(c.dir, f.Name()))
+			if err != nil {
+				return errors.Wrap(err, "removing expired cache entry")
+			}
+			continue
+		}
+
+		entry := buildCacheEntry{
+			path:    filepath.Join(c.dir, f.Name()),
+			lastUse: f.ModTime(),
+		}
+		entry.size, err = dirSize(entry.path)
+		if err != nil {
+			return errors.Wrapf(err, "getting size of cache entry %s", f.Name())
+		}
+
+		total += entry.size
+		entries = append(entries, entry)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].lastUse.Before(entries[j].lastUse)
+	})
+
+	for len(entries) > 0 &&
+		((c.maxSize > 0 && total > c.maxSize) || (c.maxEntries > 0 && len(entries) > c.maxEntries)) {
+		log.Printf("Evicting %s from build cache", filepath.Base(entries[0].path))
+
+		err = os.RemoveAll(entries[0].path)
+		if err != nil {
+			return errors.Wrap(err, "removing cache entry")
+		}
+
+		total -= entries[0].size
+		entries = entries[1:]
+	}
+
+	return nil
+}
+
+// clearDir removes the content of the directory, but not the directory itself
+func clearDir(dir string) error {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range files {
+		err = os.RemoveAll(filepath.Join(dir, f.Name()))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func dirSize(dir string) (int64, error) {
+	size := int64(0)
+	err := filepath.Walk(dir, func(_ string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+
+	return size, err
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBuildCacheKey(t *testing.T) {
+	cfg := Config{Images: map[string]string{"golang": "hyperledger/fabric-ccenv:2.2.1"}}
+	cfg.Builder.Resources.LimitMemory = "0.5G"
+	metadata := &ChaincodeMetadata{
+		Type:        "golang",
+		Path:        "github.com/example/mycc",
+		Label:       "mycc_v1",
+		SourceHash:  "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+		PackageHash: "afb437d0b8b4a8b3a5c1f5e7e3a0d1c9afb437d0b8b4a8b3a5c1f5e7e3a0d1c9",
+	}
+
+	tests := []struct {
+		name     string
+		override Override
+		equal    bool
+	}{
+		{name: "override of other chaincode", override: Override{Label: "other", Builder: PodConfig{Env: map[string]string{"GOFLAGS": "-tags=x"}}}, equal: true},
+		{name: "builder env", override: Override{Label: "mycc_v1", Builder: PodConfig{Env: map[string]string{"GOFLAGS": "-tags=x"}}}, equal: false},
+		{name: "builder resources", override: Override{Label: "mycc_v1", Builder: PodConfig{Resources: Resources{LimitMemory: "2G"}}}, equal: false},
+		{
+			name: "builder pod template",
+			override: Override{Label: "mycc_v1", Builder: PodConfig{PodTemplate: PodTemplate{
+				"spec": map[string]interface{}{"nodeSelector": map[string]interface{}{"kubernetes.io/arch": "arm64"}},
+			}}},
+			equal: false,
+		},
+		{name: "builder image", override: Override{Label: "mycc_v1", Images: map[string]string{"golang": "example/ccenv:2.2.1"}}, equal: false},
+		{name: "chaincode env", override: Override{Label: "mycc_v1", Launcher: PodConfig{Env: map[string]string{"DEBUG": "1"}}}, equal: true},
+	}
+
+	c := &buildCache{}
+	want, err := c.Key(cfg, metadata)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			overridden := cfg
+			overridden.Overrides = []Override{tt.override}
+			overridden, err := overridden.ForChaincode(metadata.Label, "Org1MSP")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := c.Key(overridden, metadata)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (got == want) != tt.equal {
+				t.Errorf("key equal = %t, want %t", got == want, tt.equal)
+			}
+		})
+	}
+}
+
+func TestSharedBuildsStore(t *testing.T) {
+	tests := []struct {
+		name    string
+		waiting bool
+		want    bool
+	}{
+		{name: "without waiting build", waiting: false, want: false},
+		{name: "with waiting build", waiting: true, want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmp, err := ioutil.TempDir("", "k8scc-test-")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(tmp)
+
+			cfg := Config{}
+			cfg.TransferVolume.Path = tmp
+			c, err := newSharedBuilds(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			outputDir := filepath.Join(tmp, "bld")
+			if err := os.MkdirAll(outputDir, 0700); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(filepath.Join(outputDir, "chaincode"), []byte("binary"), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			if tt.waiting {
+				if err := c.AddWaiter("key"); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := c.Store("key", outputDir); err != nil {
+				t.Fatal(err)
+			}
+
+			hit, err := c.Restore("key", filepath.Join(tmp, "restored"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if hit != tt.want {
+				t.Errorf("Restore() = %t, want %t", hit, tt.want)
+			}
+			if _, err := os.Stat(c.waiterPath("key")); !os.IsNotExist(err) {
+				t.Errorf("waiting marker exists after the store: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,596 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+
+	cpy "github.com/otiai10/copy"
+	"github.com/pkg/errors"
+	appsv1 "k8s.io/api/apps/v1"
+	apiv1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+const (
+	// LauncherModePod launches the chaincode as a Pod, which connects to the peer
+	LauncherModePod = "pod"
+	// LauncherModeCCaaS launches the chaincode as a Deployment and Service, the peer connects to the chaincode
+	LauncherModeCCaaS = "ccaas"
+
+	defaultCCaaSPort = 9999
+)
+
+// CCaaSConfig defines the configuration for chaincode as a service
+type CCaaSConfig struct {
+	Port        int    `yaml:"port"`
+	DialTimeout string `yaml:"dial_timeout"`
+	TLS         struct {
+		Enabled        bool   `yaml:"enabled"`
+		CertFile       string `yaml:"cert_file"`        // server certificate of the chaincode
+		KeyFile        string `yaml:"key_file"`         // server key of the chaincode
+		RootCertFile   string `yaml:"root_cert_file"`   // CA of the server certificate, used by the peer
+		ClientAuth     bool   `yaml:"client_auth"`      // require a client certificate from the peer
+		ClientCertFile string `yaml:"client_cert_file"` // client certificate of the peer
+		ClientKeyFile  string `yaml:"client_key_file"`  // client key of the peer
+		ClientRootFile string `yaml:"client_root_file"` // CA of the client certificate, used by the chaincode
+	} `yaml:"tls"`
+}
+
+// CCaaSArtifacts is the TLS material of the chaincode server, which is mounted at /chaincode/artifacts/
+type CCaaSArtifacts struct {
+	ServerCert     string // PEM encoded server certificate of the chaincode
+	ServerKey      string // PEM encoded server key of the chaincode
+	ClientRootCert string // PEM encoded CA of the peer client certificate, only with client authentication
+}
+
+// ChaincodeServerInfo is based on
+// https://github.com/hyperledger/fabric/blob/v2.2.1/core/container/externalbuilder/instance.go#L32
+type ChaincodeServerInfo struct {
+	Address            string `json:"address"`
+	DialTimeout        string `json:"dial_timeout,omitempty"`
+	TLSRequired        bool   `json:"tls_required"`
+	ClientAuthRequired bool   `json:"client_auth_required"`
+	ClientKey          string `json:"client_key,omitempty"`  // PEM encoded client key
+	ClientCert         string `json:"client_cert,omitempty"` // PEM encoded client certificate
+	RootCert           string `json:"root_cert,omitempty"`   // PEM encoded chaincode server root certificate
+}
+
+// ccidRegexp extracts the chaincode ID from the build context directory of the peer, which is
+// created as TempDir("", "fabric-"+SanitizeCCIDPath(ccid)), see
+// https://github.com/hyperledger/fabric/blob/v2.2.1/core/container/externalbuilder/externalbuilder.go#L184
+var ccidRegexp = regexp.MustCompile(`^fabric-(.+:[0-9a-f]{64})[0-9]*$`) // nolint:gochecknoglobals
+
+// ReleaseCCaaS launches the chaincode as a service and writes the connection.json for the peer
+func ReleaseCCaaS(ctx context.Context, cfg Config, sourceDir, outputDir string) error {
+	if cfg.Transfer.Mode == TransferModeExec {
+		return errors.New("chaincode as a service requires the transfer mode pv")
+	}
+
+	ccid, err := getCCIDFromBuildDir(sourceDir)
+	if err != nil {
+		return errors.Wrap(err, "getting chaincode ID")
+	}
+
+	// Apply per chaincode configuration
+	cfg, err = cfg.ForChaincode(getChaincodeLabel(ccid), getPeerMSPID())
+	if err != nil {
+		return errors.Wrap(err, "applying overrides")
+	}
+
+	// The chaincode may run in another namespace or cluster
+	cfg, err = cfg.ForLauncher()
+	if err != nil {
+		return errors.Wrap(err, "getting target of chaincode")
+	}
+
+	buildInformation, err := getBuildInformation(sourceDir)
+	if err != nil {
+		return errors.Wrap(err, "getting build information")
+	}
+
+	port := cfg.Launcher.CCaaS.Port
+	if port == 0 {
+		port = defaultCCaaSPort
+	}
+
+	peer, err := getPeerPod(ctx, cfg)
+	if err != nil {
+		return errors.Wrap(err, "getting myself Pod")
+	}
+
+	// The chaincode has to survive the transfer directory of this process,
+	// therefore we use a persistent directory per chaincode.
+	name, err := getLauncherPodName(cfg, peer.Name, ccid, getPeerMSPID())
+	if err != nil {
+		return errors.Wrap(err, "getting chaincode name")
+	}
+	transferPrefix := filepath.Join("ccaas", name)
+	transferdir := filepath.Join(cfg.TransferVolume.Path, transferPrefix)
+	transferOutput := filepath.Join(transferdir, "output")
+	transferArtifacts := filepath.Join(transferdir, "artifacts")
+
+	err = os.RemoveAll(transferdir)
+	if err != nil {
+		return errors.Wrap(err, "removing existing chaincode dir in the transfer volume")
+	}
+
+	err = cpy.Copy(sourceDir, transferOutput, cpy.Options{AddPermission: os.ModePerm})
+	if err != nil {
+		return errors.Wrap(err, "copy build output to transfer dir")
+	}
+
+	// The TLS material of the chaincode server is delivered in a Secret or written to the transfer volume
+	tlsCfg := cfg.Launcher.CCaaS.TLS
+	useSecret := tlsCfg.Enabled && cfg.Launcher.Artifacts == ArtifactsSecret
+	artifacts := &CCaaSArtifacts{}
+	if tlsCfg.Enabled {
+		artifacts, err = readCCaaSArtifacts(&cfg.Launcher.CCaaS)
+		if err != nil {
+			return err
+		}
+	}
+	if !useSecret {
+		err = createCCaaSArtifacts(artifacts, transferArtifacts)
+		if err != nil {
+			return errors.Wrap(err, "creating artifacts")
+		}
+	}
+
+	// Create chaincode Deployment and Service
+	info := getCCaaSInfo(name, ccid, getPeerMSPID(), peer, buildInformation)
+	deployment, err := newChaincodeDeployment(cfg, info, buildInformation, transferPrefix, port)
+	if err != nil {
+		return err
+	}
+
+	deployment, err = applyChaincodeDeployment(ctx, cfg, deployment)
+	if err != nil {
+		return errors.Wrap(err, "applying chaincode deployment")
+	}
+
+	// The Secret is owned by the Deployment, so it is deleted together with the Deployment
+	if useSecret {
+		err = applyCCaaSArtifactsSecret(ctx, cfg, newCCaaSArtifactsSecret(deployment, artifacts))
+		if err != nil {
+			return errors.Wrap(err, "applying artifacts secret")
+		}
+	}
+
+	svc, err := applyChaincodeService(ctx, cfg, newChaincodeService(cfg, info, port))
+	if err != nil {
+		return errors.Wrap(err, "applying chaincode service")
+	}
+
+	// Write connection.json
+	serverInfo := ChaincodeServerInfo{
+		Address:            fmt.Sprintf("%s.%s.svc:%d", svc.Name, svc.Namespace, port),
+		DialTimeout:        cfg.Launcher.CCaaS.DialTimeout,
+		TLSRequired:        tlsCfg.Enabled,
+		ClientAuthRequired: tlsCfg.Enabled && tlsCfg.ClientAuth,
+	}
+	if serverInfo.TLSRequired {
+		serverInfo.RootCert, err = readPEMFile(tlsCfg.RootCertFile)
+		if err != nil {
+			return errors.Wrap(err, "reading chaincode server root certificate")
+		}
+	}
+	if serverInfo.ClientAuthRequired {
+		serverInfo.ClientCert, err = readPEMFile(tlsCfg.ClientCertFile)
+		if err != nil {
+			return errors.Wrap(err, "reading peer client certificate")
+		}
+		serverInfo.ClientKey, err = readPEMFile(tlsCfg.ClientKeyFile)
+		if err != nil {
+			return errors.Wrap(err, "reading peer client key")
+		}
+	}
+
+	return writeConnectionJSON(outputDir, &serverInfo)
+}
+
+func getCCIDFromBuildDir(buildDir string) (string, error) {
+	absDir, err := filepath.Abs(buildDir)
+	if err != nil {
+		return "", errors.Wrap(err, "getting absolute path of build dir")
+	}
+
+	contextDir := filepath.Base(filepath.Dir(absDir))
+	m := ccidRegexp.FindStringSubmatch(contextDir)
+	if m == nil {
+		return "", fmt.Errorf("cannot extract chaincode ID from build context %q", contextDir)
+	}
+
+	return m[1], nil
+}
+
+// getCCaaSSelector returns the labels selecting the pods of a chaincode as a service
+func getCCaaSSelector(name string) map[string]string {
+	return map[string]string{
+		"externalcc-type": ComponentCCaaS,
+		"externalcc-name": name,
+	}
+}
+
+// readCCaaSArtifacts reads the TLS material of the chaincode server from the configured files
+func readCCaaSArtifacts(c *CCaaSConfig) (*CCaaSArtifacts, error) {
+	artifacts := &CCaaSArtifacts{}
+
+	var err error
+	artifacts.ServerCert, err = readPEMFile(c.TLS.CertFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading chaincode server certificate")
+	}
+	artifacts.ServerKey, err = readPEMFile(c.TLS.KeyFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading chaincode server key")
+	}
+	if c.TLS.ClientAuth {
+		artifacts.ClientRootCert, err = readPEMFile(c.TLS.ClientRootFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "reading peer client root certificate")
+		}
+	}
+
+	return artifacts, nil
+}
+
+// getCCaaSArtifacts returns the files of the TLS material of the chaincode server
+func getCCaaSArtifacts(a *CCaaSArtifacts) map[string][]byte {
+	files := map[string][]byte{}
+	if a.ServerCert != "" {
+		files["server.crt"] = []byte(a.ServerCert)
+		files["server.key"] = []byte(a.ServerKey)
+	}
+	if a.ClientRootCert != "" {
+		files["client_root.crt"] = []byte(a.ClientRootCert)
+	}
+
+	return files
+}
+
+// createCCaaSArtifacts writes the TLS material of the chaincode server, which is only readable by the user of the peer
+func createCCaaSArtifacts(a *CCaaSArtifacts, dir string) error {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return errors.Wrap(err, "creating artifacts dir")
+	}
+	err = os.Chmod(dir, 0700)
+	if err != nil {
+		return errors.Wrap(err, "chmod on artifacts dir")
+	}
+
+	for name, data := range getCCaaSArtifacts(a) {
+		err = ioutil.WriteFile(filepath.Join(dir, name), data, 0600)
+		if err != nil {
+			return errors.Wrapf(err, "writing %s", name)
+		}
+	}
+
+	return nil
+}
+
+func readPEMFile(path string) (string, error) {
+	if path == "" {
+		return "", errors.New("no file configured")
+	}
+
+	data, err := ioutil.ReadFile(path) // #nosec G304
+	if err != nil {
+		return "", err
+	}
+
+	return string(data), nil
+}
+
+func writeConnectionJSON(outputDir string, serverInfo *ChaincodeServerInfo) error {
+	serverDir := filepath.Join(outputDir, "chaincode", "server")
+	err := os.MkdirAll(serverDir, 0750)
+	if err != nil {
+		return errors.Wrap(err, "creating chaincode server dir")
+	}
+
+	data, err := json.Marshal(serverInfo)
+	if err != nil {
+		return errors.Wrap(err, "marshaling connection.json")
+	}
+
+	err = ioutil.WriteFile(filepath.Join(serverDir, "connection.json"), data, 0600)
+	return errors.Wrap(err, "writing connection.json")
+}
+
+// getCCaaSInfo describes the chaincode as a service for its labels and annotations
+func getCCaaSInfo(name, ccid, mspid string, peer *apiv1.Pod, buildInformation *BuildInformation) *ChaincodeInfo {
+	return &ChaincodeInfo{
+		Component:     ComponentCCaaS,
+		Instance:      name,
+		CCID:          ccid,
+		Label:         getChaincodeLabel(ccid),
+		MSPID:         mspid,
+		Peer:          peer.Name,
+		PeerNamespace: peer.Namespace,
+		PeerUID:       string(peer.UID),
+		Platform:      buildInformation.Platform,
+		Image:         buildInformation.Image,
+		SourceHash:    buildInformation.SourceHash,
+	}
+}
+
+// newChaincodeDeployment returns the Deployment of the chaincode as a service
+func newChaincodeDeployment(cfg Config, info *ChaincodeInfo,
+	buildInformation *BuildInformation, transferPVPrefix string, port int) (*appsv1.Deployment, error) {
+	name := info.Instance
+	ccid := info.CCID
+
+	// Set resources
+	limits, err := cfg.Launcher.Resources.Limits()
+	if err != nil {
+		return nil, errors.Wrap(err, "getting chaincode resources")
+	}
+
+	// Configuration
+	envvars := []apiv1.EnvVar{
+		{
+			Name:  "CHAINCODE_SERVER_ADDRESS",
+			Value: fmt.Sprintf("0.0.0.0:%d", port),
+		},
+		{
+			Name:  "CHAINCODE_ID",
+			Value: ccid,
+		},
+		{
+			Name:  "CORE_CHAINCODE_ID_NAME",
+			Value: ccid,
+		},
+		{
+			Name:  "CHAINCODE_TLS_DISABLED",
+			Value: fmt.Sprintf("%t", !cfg.Launcher.CCaaS.TLS.Enabled),
+		},
+	}
+	if cfg.Launcher.CCaaS.TLS.Enabled {
+		envvars = append(envvars,
+			apiv1.EnvVar{
+				Name:  "CHAINCODE_TLS_CERT",
+				Value: "/chaincode/artifacts/server.crt",
+			},
+			apiv1.EnvVar{
+				Name:  "CHAINCODE_TLS_KEY",
+				Value: "/chaincode/artifacts/server.key",
+			},
+		)
+		if cfg.Launcher.CCaaS.TLS.ClientAuth {
+			envvars = append(envvars, apiv1.EnvVar{
+				Name:  "CHAINCODE_CLIENT_CA_CERT",
+				Value: "/chaincode/artifacts/client_root.crt",
+			})
+		}
+	}
+
+	envvars = append(envvars, cfg.Launcher.EnvVars()...)
+
+	// The selector of a Deployment is immutable, therefore it contains only the name
+	selector := getCCaaSSelector(name)
+	labels := mergeMaps(info.Labels(cfg.Launcher.Labels), selector)
+	annotations := info.Annotations(cfg.Launcher.Annotations)
+
+	// Deployment
+	deployment := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Labels:      labels,
+			Annotations: annotations,
+		},
+		Spec: appsv1.DeploymentSpec{
+			Replicas: Int32Ref(1),
+			Selector: &metav1.LabelSelector{MatchLabels: selector},
+			Strategy: appsv1.DeploymentStrategy{Type: appsv1.RecreateDeploymentStrategyType},
+			Template: apiv1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels:      labels,
+					Annotations: annotations,
+				},
+				Spec: apiv1.PodSpec{
+					Containers: []apiv1.Container{
+						{
+							Name:            "chaincode",
+							Image:           buildInformation.Image,
+							ImagePullPolicy: apiv1.PullIfNotPresent,
+							Env:             envvars,
+							WorkingDir:      GetCCMountDir(buildInformation.Platform),
+							Command:         GetServerArgs(buildInformation.Platform),
+							Resources:       apiv1.ResourceRequirements{Limits: limits},
+							Ports: []apiv1.ContainerPort{
+								{
+									Name:          "chaincode",
+									ContainerPort: int32(port),
+									Protocol:      apiv1.ProtocolTCP,
+								},
+							},
+							VolumeMounts: []apiv1.VolumeMount{
+								{
+									Name:      "transfer-pv",
+									MountPath: "/chaincode/artifacts/",
+									SubPath:   transferPVPrefix + "/artifacts/",
+									ReadOnly:  true,
+								},
+								{
+									Name:      "transfer-pv",
+									MountPath: GetCCMountDir(buildInformation.Platform),
+									SubPath:   transferPVPrefix + "/output/",
+									ReadOnly:  true,
+								},
+							},
+						},
+					},
+					EnableServiceLinks: BoolRef(false),
+					Volumes: []apiv1.Volume{
+						{
+							Name: "transfer-pv",
+							VolumeSource: apiv1.VolumeSource{
+								PersistentVolumeClaim: &apiv1.PersistentVolumeClaimVolumeSource{
+									ClaimName: cfg.TransferVolume.Claim,
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	// Prebuilt images are started by their own entrypoint and don't require the build output
+	if IsPrebuiltImage(buildInformation.Platform) {
+		container := &deployment.Spec.Template.Spec.Containers[0]
+		container.Command = nil
+		container.WorkingDir = ""
+		container.VolumeMounts = container.VolumeMounts[:1] // artifacts only
+	}
+
+	// Mount the TLS material from a Secret instead of the transfer volume
+	if cfg.Launcher.CCaaS.TLS.Enabled && cfg.Launcher.Artifacts == ArtifactsSecret {
+		useArtifactsSecret(&deployment.Spec.Template.Spec, getCCaaSArtifactsSecretName(name))
+	}
+
+	// Customize pod
+	err = applyPodTemplateSpec(cfg.Launcher.PodTemplate, &deployment.Spec.Template)
+	if err != nil {
+		return nil, errors.Wrap(err, "applying launcher pod template")
+	}
+
+	return deployment, nil
+}
+
+// applyChaincodeDeployment creates the Deployment or updates the pod template of the existing one
+func applyChaincodeDeployment(ctx context.Context, cfg Config, deployment *appsv1.Deployment) (*appsv1.Deployment, error) {
+	// Setup kubernetes client
+	clientset, err := getKubernetesClientset(cfg)
+	if err != nil {
+		return nil, errors.Wrap(err, "getting kubernetes clientset")
+	}
+
+	name := deployment.Name
+	deployments := clientset.AppsV1().Deployments(cfg.Namespace)
+	existing, err := deployments.Get(ctx, name, metav1.GetOptions{})
+	if k8serrors.IsNotFound(err) {
+		log.Printf("Creating chaincode deployment %s", name)
+		return deployments.Create(ctx, deployment, metav1.CreateOptions{})
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "getting existing chaincode deployment")
+	}
+
+	// Replace the pod template of the existing deployment, e.g. after a restart of the peer
+	log.Printf("Updating chaincode deployment %s", name)
+	existing.Labels = deployment.Labels
+	existing.Annotations = mergeMaps(existing.Annotations, deployment.Annotations)
+	existing.Spec.Template = deployment.Spec.Template
+	return deployments.Update(ctx, existing, metav1.UpdateOptions{})
+}
+
+func getCCaaSArtifactsSecretName(name string) string {
+	return name + "-artifacts"
+}
+
+// newCCaaSArtifactsSecret returns the Secret with the TLS material of the chaincode server owned by its Deployment
+func newCCaaSArtifactsSecret(deployment *appsv1.Deployment, artifacts *CCaaSArtifacts) *apiv1.Secret {
+	secret := &apiv1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   getCCaaSArtifactsSecretName(deployment.Name),
+			Labels: deployment.Labels,
+		},
+		Type: apiv1.SecretTypeOpaque,
+		Data: getCCaaSArtifacts(artifacts),
+	}
+	if deployment.UID != "" {
+		secret.OwnerReferences = []metav1.OwnerReference{
+			{
+				APIVersion: "apps/v1",
+				Kind:       "Deployment",
+				Name:       deployment.Name,
+				UID:        deployment.UID,
+			},
+		}
+	}
+
+	return secret
+}
+
+// applyCCaaSArtifactsSecret creates the Secret or updates the TLS material of the existing one
+func applyCCaaSArtifactsSecret(ctx context.Context, cfg Config, secret *apiv1.Secret) error {
+	// Setup kubernetes client
+	clientset, err := getKubernetesClientset(cfg)
+	if err != nil {
+		return errors.Wrap(err, "getting kubernetes clientset")
+	}
+
+	secrets := clientset.CoreV1().Secrets(cfg.Namespace)
+	existing, err := secrets.Get(ctx, secret.Name, metav1.GetOptions{})
+	if k8serrors.IsNotFound(err) {
+		_, err = secrets.Create(ctx, secret, metav1.CreateOptions{})
+		return err
+	}
+	if err != nil {
+		return errors.Wrap(err, "getting existing artifacts secret")
+	}
+
+	existing.Labels = secret.Labels
+	existing.OwnerReferences = secret.OwnerReferences
+	existing.Data = secret.Data
+	_, err = secrets.Update(ctx, existing, metav1.UpdateOptions{})
+	return err
+}
+
+// newChaincodeService returns the Service of the chaincode as a service
+func newChaincodeService(cfg Config, info *ChaincodeInfo, port int) *apiv1.Service {
+	name := info.Instance
+	selector := getCCaaSSelector(name)
+
+	return &apiv1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Labels:      mergeMaps(info.Labels(cfg.Launcher.Labels), selector),
+			Annotations: info.Annotations(cfg.Launcher.Annotations),
+		},
+		Spec: apiv1.ServiceSpec{
+			Type:     apiv1.ServiceTypeClusterIP,
+			Selector: selector,
+			Ports: []apiv1.ServicePort{
+				{
+					Name:       "chaincode",
+					Port:       int32(port),
+					TargetPort: intstr.FromString("chaincode"),
+					Protocol:   apiv1.ProtocolTCP,
+				},
+			},
+		},
+	}
+}
+
+// applyChaincodeService creates the Service, unless it exists
+func applyChaincodeService(ctx context.Context, cfg Config, service *apiv1.Service) (*apiv1.Service, error) {
+	// Setup kubernetes client
+	clientset, err := getKubernetesClientset(cfg)
+	if err != nil {
+		return nil, errors.Wrap(err, "getting kubernetes clientset")
+	}
+
+	name := service.Name
+	services := clientset.CoreV1().Services(cfg.Namespace)
+	existing, err := services.Get(ctx, name, metav1.GetOptions{})
+	if k8serrors.IsNotFound(err) {
+		log.Printf("Creating chaincode service %s", name)
+		return services.Create(ctx, service, metav1.CreateOptions{})
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "getting existing chaincode service")
+	}
+
+	return existing, nil
+}
@@ -0,0 +1,509 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+	yamlv3 "gopkg.in/yaml.v3"
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+const defaultConfigFile = "/opt/k8scc/k8scc.yaml"
+
+// imageReferenceRegexp matches an image reference with optional registry, tag and digest, see
+// https://github.com/distribution/distribution/blob/v2.7.1/reference/regexp.go
+var imageReferenceRegexp = regexp.MustCompile(`^` + // nolint:gochecknoglobals
+	`(?:[a-zA-Z0-9](?:[a-zA-Z0-9-]*[a-zA-Z0-9])?(?:\.[a-zA-Z0-9](?:[a-zA-Z0-9-]*[a-zA-Z0-9])?)*(?::[0-9]+)?/)?` +
+	`[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*(?:/[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*)*` +
+	`(?::[\w][\w.-]{0,127})?` +
+	`(?:@[A-Za-z][A-Za-z0-9]*(?:[-_+.][A-Za-z][A-Za-z0-9]*)*:[0-9a-fA-F]{32,})?$`)
+
+// yamlLineErrorRegexp matches the line number in the errors of the YAML decoder
+var yamlLineErrorRegexp = regexp.MustCompile(`^line (\d+): (.*)$`) // nolint:gochecknoglobals
+
+// yamlUnknownFieldRegexp matches the errors of unknown fields, which name the Go type of the configuration
+var yamlUnknownFieldRegexp = regexp.MustCompile(`^field (.+) not found in type .*$`) // nolint:gochecknoglobals
+
+// ConfigError is a problem of the configuration at a path like builder.resources.memory_limit
+type ConfigError struct {
+	Line    int
+	Path    string
+	Message string
+}
+
+func (e ConfigError) Error() string {
+	s := e.Message
+	if e.Path != "" {
+		s = e.Path + ": " + s
+	}
+	if e.Line > 0 {
+		s = fmt.Sprintf("line %d: %s", e.Line, s)
+	}
+
+	return s
+}
+
+// ConfigErrors are all problems found in the configuration
+type ConfigErrors []ConfigError
+
+func (e ConfigErrors) Error() string {
+	lines := make([]string, 0, len(e))
+	for _, err := range e {
+		lines = append(lines, err.Error())
+	}
+
+	return fmt.Sprintf("%d problems found:\n%s", len(e), strings.Join(lines, "\n"))
+}
+
+// ValidateConfig validates the configuration file passed as argument, which defaults to the configuration of k8scc
+func ValidateConfig(ctx context.Context, cfg Config) error {
+	flags := flag.NewFlagSet("validate-config", flag.ContinueOnError)
+	err := flags.Parse(getCommandArgs("validate-config"))
+	if err != nil {
+		return err
+	}
+
+	cfgFile := getConfigFile()
+	if flags.NArg() > 0 {
+		cfgFile = flags.Arg(0)
+	}
+
+	_, err = loadConfig(cfgFile)
+	if err != nil {
+		return errors.Wrapf(err, "configuration file %s", cfgFile)
+	}
+
+	fmt.Printf("Configuration file %s is valid\n", cfgFile)
+	return nil
+}
+
+// getConfigFile returns the path of the configuration file
+func getConfigFile() string {
+	cfgFile := os.Getenv("K8SCC_CFGFILE")
+	if cfgFile == "" {
+		cfgFile = defaultConfigFile
+	}
+
+	return cfgFile
+}
+
+// loadConfig reads the configuration file, rejects unknown fields and validates the values.
+// All problems are returned at once as ConfigErrors.
+func loadConfig(cfgFile string) (Config, error) {
+	cfg := Config{}
+	data, err := ioutil.ReadFile(cfgFile) // #nosec G304
+	if err != nil {
+		return cfg, err
+	}
+
+	lines := newYAMLLines(data)
+	err = yaml.UnmarshalStrict(data, &cfg)
+	if typeErr, ok := err.(*yaml.TypeError); ok {
+		// Unknown fields and values of the wrong type are reported with their line
+		problems := ConfigErrors{}
+		for _, msg := range typeErr.Errors {
+			problem := ConfigError{Message: msg}
+			if m := yamlLineErrorRegexp.FindStringSubmatch(msg); m != nil {
+				problem.Line, _ = strconv.Atoi(m[1])
+				problem.Path = lines.path(problem.Line)
+				problem.Message = m[2]
+			}
+			if m := yamlUnknownFieldRegexp.FindStringSubmatch(problem.Message); m != nil {
+				problem.Message = "unknown field " + m[1]
+			}
+			problems = append(problems, problem)
+		}
+		return cfg, problems
+	}
+	if err != nil {
+		return cfg, err
+	}
+
+	problems := cfg.Validate()
+	if len(problems) > 0 {
+		for i := range problems {
+			problems[i].Line = lines.find(problems[i].Path)
+		}
+		sort.SliceStable(problems, func(i, j int) bool {
+			return problems[i].Line < problems[j].Line
+		})
+		return cfg, problems
+	}
+
+	return cfg, nil
+}
+
+// configValidator collects the problems of a configuration
+type configValidator struct {
+	problems ConfigErrors
+}
+
+// Validate returns the problems of the configuration without line numbers
+func (cfg *Config) Validate() ConfigErrors {
+	v := &configValidator{}
+
+	v.images("images", cfg.Images)
+
+	switch cfg.Transfer.Mode {
+	case "", TransferModePV:
+		v.absPath("transfer_volume.path", cfg.TransferVolume.Path, true)
+		v.claim("transfer_volume.claim", cfg.TransferVolume.Claim)
+	case TransferModeExec:
+	default:
+		v.add("transfer.mode", "unknown mode %q, use %s or %s", cfg.Transfer.Mode, TransferModePV, TransferModeExec)
+	}
+	if cfg.Transfer.Image != "" {
+		v.image("transfer.image", cfg.Transfer.Image)
+	}
+
+	v.podConfig("builder", &cfg.Builder.PodConfig)
+	v.nameTemplate("builder.name_template", cfg.Builder.NameTemplate, defaultBuilderNameTemplate)
+	switch cfg.Builder.Kind {
+	case "", BuilderKindPod:
+	case BuilderKindJob:
+		if cfg.Transfer.Mode == TransferModeExec {
+			v.add("builder.kind", "builder kind %s requires the transfer mode %s", BuilderKindJob, TransferModePV)
+		}
+	default:
+		v.add("builder.kind", "unknown kind %q, use %s or %s", cfg.Builder.Kind, BuilderKindPod, BuilderKindJob)
+	}
+	if cfg.Builder.MaxConcurrent < 0 {
+		v.add("builder.max_concurrent", "must not be negative")
+	}
+	if b := cfg.Builder.Job.BackoffLimit; b != nil && *b < 0 {
+		v.add("builder.job.backoff_limit", "must not be negative")
+	}
+	v.duration("builder.job.active_deadline", cfg.Builder.Job.ActiveDeadline)
+	if ttl := cfg.Builder.Job.TTLAfterFinished; ttl != nil {
+		v.duration("builder.job.ttl_after_finished", *ttl)
+	}
+	if cfg.Builder.Cache.Path != "" {
+		v.absPath("builder.cache.path", cfg.Builder.Cache.Path, false)
+	} else if cfg.Builder.Cache.Enabled && cfg.TransferVolume.Path == "" {
+		v.add("builder.cache.path", "required without transfer_volume.path, e.g. in the transfer mode %s", TransferModeExec)
+	}
+	if cfg.Builder.Cache.MaxSize != "" {
+		v.quantity("builder.cache.max_size", cfg.Builder.Cache.MaxSize)
+	}
+	if cfg.Builder.Cache.MaxEntries < 0 {
+		v.add("builder.cache.max_entries", "must not be negative")
+	}
+
+	v.podConfig("launcher", &cfg.Launcher.PodConfig)
+	v.nameTemplate("launcher.name_template", cfg.Launcher.NameTemplate, defaultLauncherNameTemplate)
+	switch cfg.Launcher.Mode {
+	case "", LauncherModePod:
+	case LauncherModeCCaaS:
+		if cfg.Transfer.Mode == TransferModeExec {
+			v.add("launcher.mode", "mode %s requires the transfer mode %s", LauncherModeCCaaS, TransferModePV)
+		}
+	default:
+		v.add("launcher.mode", "unknown mode %q, use %s or %s", cfg.Launcher.Mode, LauncherModePod, LauncherModeCCaaS)
+	}
+	switch cfg.Launcher.Artifacts {
+	case "", ArtifactsTransfer, ArtifactsSecret:
+	default:
+		v.add("launcher.artifacts", "unknown value %q, use %s or %s", cfg.Launcher.Artifacts, ArtifactsTransfer, ArtifactsSecret)
+	}
+	v.ccaas("launcher.ccaas", &cfg.Launcher.CCaaS)
+
+	for i := range cfg.Overrides {
+		o := &cfg.Overrides[i]
+		path := fmt.Sprintf("overrides.%d", i)
+		if err := o.compile(); err != nil {
+			v.add(path+".label", "invalid regular expression %q: %s", o.Label, err)
+		}
+		v.images(path+".images", o.Images)
+		v.podConfig(path+".builder", &o.Builder)
+		v.podConfig(path+".launcher", &o.Launcher)
+	}
+
+	v.kubernetes("kubernetes", &cfg.Kubernetes, os.Getenv("K8SCC_KUBECONFIG"))
+	v.target("builder", &cfg.Builder.TargetConfig)
+	v.target("launcher", &cfg.Launcher.TargetConfig)
+
+	if cfg.LogTail.Lines < 0 {
+		v.add("log_tail.lines", "must not be negative")
+	}
+	if cfg.LogTail.Bytes < 0 {
+		v.add("log_tail.bytes", "must not be negative")
+	}
+
+	v.duration("timeouts.unschedulable", cfg.Timeouts.Unschedulable)
+	v.duration("timeouts.pending", cfg.Timeouts.Pending)
+	v.duration("timeouts.build", cfg.Timeouts.Build)
+	v.duration("timeouts.startup", cfg.Timeouts.Startup)
+	if grace := cfg.Timeouts.DeletionGracePeriod; grace != nil {
+		v.duration("timeouts.deletion_grace_period", *grace)
+	}
+
+	return v.problems
+}
+
+// add adds a problem at the path
+func (v *configValidator) add(path, format string, args ...interface{}) {
+	v.problems = append(v.problems, ConfigError{Path: path, Message: fmt.Sprintf(format, args...)})
+}
+
+// podConfig validates the configuration of the builder or chaincode pods
+func (v *configValidator) podConfig(path string, p *PodConfig) {
+	if p.Resources.LimitMemory != "" {
+		v.quantity(path+".resources.memory_limit", p.Resources.LimitMemory)
+	}
+	if p.Resources.LimitCPU != "" {
+		v.quantity(path+".resources.cpu_limit", p.Resources.LimitCPU)
+	}
+
+	for _, name := range sortedKeys(p.Env) {
+		for _, msg := range validation.IsEnvVarName(name) {
+			v.add(path+".env."+name, "invalid name: %s", msg)
+		}
+	}
+	for _, key := range sortedKeys(p.Labels) {
+		for _, msg := range validation.IsQualifiedName(key) {
+			v.add(path+".labels."+key, "invalid key: %s", msg)
+		}
+		for _, msg := range validation.IsValidLabelValue(p.Labels[key]) {
+			v.add(path+".labels."+key, "invalid value: %s", msg)
+		}
+	}
+	for _, key := range sortedKeys(p.Annotations) {
+		for _, msg := range validation.IsQualifiedName(key) {
+			v.add(path+".annotations."+key, "invalid key: %s", msg)
+		}
+	}
+
+	// The template must be a partial pod, which can be merged into the generated pods
+	if err := applyPodTemplate(p.PodTemplate, &apiv1.Pod{}); err != nil {
+		v.add(path+".pod_template", "%s", errors.Cause(err))
+	}
+}
+
+// ccaas validates the configuration of chaincodes as a service
+func (v *configValidator) ccaas(path string, c *CCaaSConfig) {
+	if c.Port < 0 || c.Port > 65535 {
+		v.add(path+".port", "invalid port %d", c.Port)
+	}
+	if c.DialTimeout != "" {
+		if _, err := time.ParseDuration(c.DialTimeout); err != nil {
+			v.add(path+".dial_timeout", "%s", err)
+		}
+	}
+
+	if !c.TLS.Enabled {
+		return
+	}
+	required := map[string]string{
+		"cert_file":      c.TLS.CertFile,
+		"key_file":       c.TLS.KeyFile,
+		"root_cert_file": c.TLS.RootCertFile,
+	}
+	if c.TLS.ClientAuth {
+		required["client_cert_file"] = c.TLS.ClientCertFile
+		required["client_key_file"] = c.TLS.ClientKeyFile
+		required["client_root_file"] = c.TLS.ClientRootFile
+	}
+	for _, key := range sortedKeys(required) {
+		if required[key] == "" {
+			v.add(path+".tls."+key, "required with TLS enabled")
+		}
+	}
+}
+
+// images validates the images per platform
+func (v *configValidator) images(path string, images map[string]string) {
+	for _, platform := range sortedKeys(images) {
+		v.image(path+"."+platform, images[platform])
+	}
+}
+
+// image validates an image reference
+func (v *configValidator) image(path, image string) {
+	if !imageReferenceRegexp.MatchString(image) {
+		v.add(path, "invalid image reference %q", image)
+	}
+}
+
+// quantity validates a resource quantity like 0.5G or 200m
+func (v *configValidator) quantity(path, value string) {
+	if _, err := resource.ParseQuantity(value); err != nil {
+		v.add(path, "invalid quantity %q: %s", value, err)
+	}
+}
+
+// duration validates, that a duration is not negative
+func (v *configValidator) duration(path string, d time.Duration) {
+	if d < 0 {
+		v.add(path, "must not be negative")
+	}
+}
+
+// absPath validates, that the path is absolute
+func (v *configValidator) absPath(path, value string, required bool) {
+	switch {
+	case value == "" && required:
+		v.add(path, "required")
+	case value != "" && !filepath.IsAbs(value):
+		v.add(path, "path %q is not absolute", value)
+	}
+}
+
+// kubernetes validates the connection to a cluster, defaultKubeconfig is used without a kubeconfig
+func (v *configValidator) kubernetes(path string, k *KubernetesConfig, defaultKubeconfig string) {
+	v.namespace(path+".namespace", k.Namespace)
+	if k.Context != "" && k.Kubeconfig == "" && defaultKubeconfig == "" {
+		v.add(path+".context", "requires a kubeconfig")
+	}
+}
+
+// target validates the namespace and cluster of the builder or chaincode pods
+func (v *configValidator) target(path string, t *TargetConfig) {
+	v.namespace(path+".namespace", t.Namespace)
+	if t.Kubernetes != nil {
+		v.kubernetes(path+".kubernetes", t.Kubernetes, "")
+	}
+	if t.TransferClaim != "" {
+		v.claim(path+".transfer_claim", t.TransferClaim)
+	}
+}
+
+// namespace validates the name of a namespace, if it is set
+func (v *configValidator) namespace(path, name string) {
+	if name == "" {
+		return
+	}
+	for _, msg := range validation.IsDNS1123Label(name) {
+		v.add(path, "invalid namespace %q: %s", name, msg)
+	}
+}
+
+// claim validates the name of a PersistentVolumeClaim
+func (v *configValidator) claim(path, name string) {
+	if name == "" {
+		v.add(path, "required")
+		return
+	}
+	for _, msg := range validation.IsDNS1123Subdomain(name) {
+		v.add(path, "invalid claim name %q: %s", name, msg)
+	}
+}
+
+// nameTemplate validates a name template by rendering it with example values
+func (v *configValidator) nameTemplate(path, text, defaultText string) {
+	_, err := renderPodName(text, defaultText, PodNameData{
+		Peer:  "peer0-org1-0",
+		Label: "mycc",
+		Hash:  "0123abcd",
+		MSPID: "Org1MSP",
+	})
+	if err != nil {
+		v.add(path, "%s", err)
+	}
+}
+
+// sortedKeys returns the keys of the map in order, so problems are reported in a stable order
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+// yamlLines maps the paths of the keys in a YAML document to their line numbers.
+// The paths of list items contain their index, e.g. overrides.0.builder.
+type yamlLines map[string]int
+
+// newYAMLLines indexes the keys of the document with the positions of the YAML parser,
+// so flow style, multi-line scalars, anchors and quoted keys are located correctly
+func newYAMLLines(data []byte) yamlLines {
+	lines := yamlLines{}
+	doc := yamlv3.Node{}
+	if err := yamlv3.Unmarshal(data, &doc); err != nil {
+		return lines // the syntax error is reported by the decoder of the configuration
+	}
+	lines.index("", &doc)
+
+	return lines
+}
+
+// index adds the keys and list items below the node
+func (l yamlLines) index(path string, node *yamlv3.Node) {
+	join := func(name string) string {
+		if path == "" {
+			return name
+		}
+		return path + "." + name
+	}
+
+	switch node.Kind {
+	case yamlv3.DocumentNode:
+		for _, n := range node.Content {
+			l.index(path, n)
+		}
+	case yamlv3.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+			if key.Tag == "!!merge" {
+				continue // the keys of a merged anchor are located at the anchor
+			}
+			l.add(join(key.Value), key.Line)
+			l.index(join(key.Value), value)
+		}
+	case yamlv3.SequenceNode:
+		for i, n := range node.Content {
+			l.add(join(strconv.Itoa(i)), n.Line)
+			l.index(join(strconv.Itoa(i)), n)
+		}
+	}
+}
+
+// add keeps the first line of a path
+func (l yamlLines) add(path string, line int) {
+	if _, ok := l[path]; !ok {
+		l[path] = line
+	}
+}
+
+// path returns the path of the key in the line, the key of a list item takes precedence over the item
+func (l yamlLines) path(line int) string {
+	found := ""
+	for path, n := range l {
+		if n == line && len(path) > len(found) {
+			found = path
+		}
+	}
+
+	return found
+}
+
+// find returns the line of the path or of its closest parent, or 0 if the path is unknown
+func (l yamlLines) find(path string) int {
+	for path != "" {
+		if line, ok := l[path]; ok {
+			return line
+		}
+		i := strings.LastIndex(path, ".")
+		if i < 0 {
+			break
+		}
+		path = path[:i]
+	}
+
+	return 0
+}
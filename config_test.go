@@ -0,0 +1,48 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestYAMLLinesFind(t *testing.T) {
+	data := []byte(`images:
+  golang: "golang:1.15"
+  "node:lts": node
+description: |
+  chaincode builder
+  timeout: not a key
+timeouts: {build: 10m, launch: 2m}
+builder: &builder
+  resources:
+    memory_limit: 1G
+overrides:
+  - label: analytics.*
+    builder: *builder
+  - {label: "audit", builder: {resources: {cpu_limit: "2"}}}
+`)
+
+	tests := []struct {
+		path string
+		want int
+	}{
+		{path: "images.golang", want: 2},
+		{path: "images.node:lts", want: 3},
+		{path: "description", want: 4},
+		{path: "timeout", want: 0},
+		{path: "timeouts.launch", want: 7},
+		{path: "builder.resources.memory_limit", want: 10},
+		{path: "overrides.0.builder", want: 13},
+		{path: "overrides.0.builder.resources", want: 13},
+		{path: "overrides.1.builder.resources.cpu_limit", want: 14},
+		{path: "overrides.2", want: 11},
+	}
+
+	lines := newYAMLLines(data)
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			if got := lines.find(tt.path); got != tt.want {
+				t.Errorf("find(%q) = %d, want %d", tt.path, got, tt.want)
+			}
+		})
+	}
+}
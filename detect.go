@@ -24,6 +24,17 @@ func Detect(ctx context.Context, cfg Config) error {
 		return errors.Wrap(err, "getting metadata for chaincode")
 	}
 
+	// Apply per chaincode configuration
+	cfg, err = cfg.ForChaincode(metadata.Label, getPeerMSPID())
+	if err != nil {
+		return errors.Wrap(err, "applying overrides")
+	}
+
+	// Packages with a prebuilt image don't require a builder image
+	if IsPrebuiltImage(metadata.Type) {
+		return nil
+	}
+
 	// Check if there is a valid image configured
 	_, ok := cfg.Images[metadata.Type]
 	if !ok {
@@ -0,0 +1,533 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// CheckPass, CheckWarn, CheckFail and CheckSkip are the results of a check of the command doctor
+	CheckPass = "pass"
+	CheckWarn = "warn"
+	CheckFail = "fail"
+	CheckSkip = "skip"
+
+	defaultImageCheckTimeout = 2 * time.Minute
+)
+
+// imagePullFailures are reasons of waiting containers, which show that the image cannot be pulled
+var imagePullFailures = map[string]bool{ // nolint:gochecknoglobals
+	"ErrImagePull":      true,
+	"ImagePullBackOff":  true,
+	"InvalidImageName":  true,
+	"ErrImageNeverPull": true,
+}
+
+// CheckResult is the result of a check of the command doctor
+type CheckResult struct {
+	Check   string `json:"check" yaml:"check"`
+	Result  string `json:"result" yaml:"result"`
+	Message string `json:"message,omitempty" yaml:"message,omitempty"`
+}
+
+// permission is an access to a resource, which is required by the procedures
+type permission struct {
+	group       string
+	resource    string
+	subresource string
+	verbs       []string
+}
+
+// String returns the resource in the notation of RBAC roles, e.g. pods/log or jobs.batch
+func (p permission) String() string {
+	s := p.resource
+	if p.subresource != "" {
+		s += "/" + p.subresource
+	}
+	if p.group != "" {
+		s += "." + p.group
+	}
+
+	return s
+}
+
+// doctor checks the environment of the peer, so misconfigurations are found before a chaincode is installed
+type doctor struct {
+	cfg          Config
+	clientset    *kubernetes.Clientset
+	peer         *apiv1.Pod
+	imageTimeout time.Duration
+	results      []CheckResult
+}
+
+// Doctor checks the permissions, the transfer volume and the images used by the procedures and reports
+// the result of every check. It is intended to run in the peer pod, e.g. using kubectl exec.
+func Doctor(ctx context.Context, cfg Config) error {
+	d := doctor{cfg: cfg}
+	flags := flag.NewFlagSet("doctor", flag.ContinueOnError)
+	output := flags.String("o", "table", "output format: table, json or yaml")
+	skipImages := flags.Bool("skip-images", false, "do not start pods to check the images")
+	flags.DurationVar(&d.imageTimeout, "image-timeout", defaultImageCheckTimeout, "maximum duration to pull an image")
+
+	err := flags.Parse(getCommandArgs("doctor"))
+	if err != nil {
+		return err
+	}
+
+	d.checkNamespace()
+	d.checkClient()
+	d.checkPeerPod(ctx)
+	d.checkPermissions(ctx)
+	d.checkTransferPath()
+	d.checkClaim(ctx)
+	if *skipImages {
+		d.add("images", CheckSkip, "disabled by -skip-images")
+	} else {
+		d.checkImages(ctx)
+	}
+
+	err = printOutput(os.Stdout, *output, d.results, func(w io.Writer) {
+		fmt.Fprintln(w, "CHECK\tRESULT\tMESSAGE")
+		for _, r := range d.results {
+			fmt.Fprintf(w, "%s\t%s\t%s\n", r.Check, r.Result, r.Message)
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	failed := 0
+	for _, r := range d.results {
+		if r.Result == CheckFail {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d checks failed", failed, len(d.results))
+	}
+
+	return nil
+}
+
+// add adds the result of a check
+func (d *doctor) add(check, result, message string) {
+	d.results = append(d.results, CheckResult{Check: check, Result: result, Message: message})
+}
+
+// checkNamespace checks, if the namespace is configured or available from the kubeconfig or service account
+func (d *doctor) checkNamespace() {
+	namespace, err := getNamespace(d.cfg.Kubernetes)
+	switch {
+	case err != nil:
+		d.add("namespace", CheckFail, err.Error())
+	case namespace == "":
+		d.add("namespace", CheckFail, "no namespace configured")
+	default:
+		d.add("namespace", CheckPass, namespace)
+	}
+}
+
+// checkClient checks, if the client for the API server can be created
+func (d *doctor) checkClient() {
+	var err error
+	d.clientset, err = getKubernetesClientset(d.cfg)
+	if err != nil {
+		d.clientset = nil
+		d.add("kubernetes client", CheckFail, err.Error())
+		return
+	}
+
+	d.add("kubernetes client", CheckPass, "")
+}
+
+// checkPeerPod checks, if the pod of the peer can be read. It owns all pods created by the procedures.
+func (d *doctor) checkPeerPod(ctx context.Context) {
+	if d.clientset == nil {
+		d.add("peer pod", CheckSkip, "no kubernetes client")
+		return
+	}
+
+	peer, err := getPeerPod(ctx, d.cfg)
+	if err != nil {
+		d.add("peer pod", CheckFail, err.Error())
+		return
+	}
+
+	d.peer = peer
+	if !d.cfg.Kubernetes.IsPeerPod() {
+		d.add("peer pod", CheckSkip, "the peer does not run in a pod, created objects have no owner")
+		return
+	}
+	d.add("peer pod", CheckPass, peer.Name)
+}
+
+// checkPermissions checks the permissions in the namespace of the peer and in the namespaces of the builder
+// and chaincode pods
+func (d *doctor) checkPermissions(ctx context.Context) {
+	d.checkPermissionsIn(ctx, d.cfg, d.clientset, "")
+	if d.clientset == nil {
+		return
+	}
+
+	targets, err := d.cfg.getTargets()
+	if err != nil {
+		d.add("targets", CheckFail, err.Error())
+		return
+	}
+	for _, target := range targets[1:] {
+		prefix := fmt.Sprintf("namespace %s: ", target.Namespace)
+		clientset, err := getKubernetesClientset(target)
+		if err != nil {
+			d.add(prefix+"client", CheckFail, err.Error())
+			clientset = nil
+		}
+		d.checkPermissionsIn(ctx, target, clientset, prefix)
+	}
+}
+
+// checkPermissionsIn checks the permissions of the service account with a SelfSubjectAccessReview for every verb
+func (d *doctor) checkPermissionsIn(ctx context.Context, cfg Config, clientset *kubernetes.Clientset, prefix string) {
+	for _, p := range getRequiredPermissions(cfg) {
+		check := prefix + "permission " + p.String()
+		if clientset == nil {
+			d.add(check, CheckSkip, "no kubernetes client")
+			continue
+		}
+
+		denied := []string{}
+		for _, verb := range p.verbs {
+			review := &authorizationv1.SelfSubjectAccessReview{
+				Spec: authorizationv1.SelfSubjectAccessReviewSpec{
+					ResourceAttributes: &authorizationv1.ResourceAttributes{
+						Namespace:   cfg.Namespace,
+						Verb:        verb,
+						Group:       p.group,
+						Resource:    p.resource,
+						Subresource: p.subresource,
+					},
+				},
+			}
+			res, err := clientset.AuthorizationV1().SelfSubjectAccessReviews().Create(ctx, review, metav1.CreateOptions{})
+			if err != nil {
+				denied = append(denied, fmt.Sprintf("%s (%s)", verb, err))
+				continue
+			}
+			if !res.Status.Allowed {
+				denied = append(denied, verb)
+			}
+		}
+
+		if len(denied) > 0 {
+			d.add(check, CheckFail, "denied: "+strings.Join(denied, ", "))
+			continue
+		}
+		d.add(check, CheckPass, strings.Join(p.verbs, ", "))
+	}
+}
+
+// checkTransferPath checks, if the transfer volume and the build cache are writable
+// and the permissions of the transfer directories can be set for the builder and chaincode pods
+func (d *doctor) checkTransferPath() {
+	if d.cfg.Transfer.Mode == TransferModeExec {
+		d.add("transfer path", CheckSkip, "transfer mode exec")
+		return
+	}
+
+	d.checkWritable("transfer path", d.cfg.TransferVolume.Path)
+
+	if d.cfg.Builder.Cache.Enabled {
+		path := d.cfg.Builder.Cache.Path
+		if path == "" {
+			path = filepath.Join(d.cfg.TransferVolume.Path, "cache")
+		}
+
+		// The build cache creates its directory on first use
+		err := os.MkdirAll(path, os.ModePerm)
+		if err != nil {
+			d.add("cache path", CheckFail, err.Error())
+			return
+		}
+		d.checkWritable("cache path", path)
+	}
+}
+
+// checkWritable creates a directory in the path like the procedures build and run
+func (d *doctor) checkWritable(check, path string) {
+	if path == "" {
+		d.add(check, CheckFail, "path not configured")
+		return
+	}
+
+	dir, err := ioutil.TempDir(path, "doctor")
+	if err != nil {
+		d.add(check, CheckFail, err.Error())
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	// The pods may run with another user, the procedures grant full permissions on the transfer directories
+	err = os.Chmod(dir, os.ModePerm)
+	if err != nil {
+		d.add(check, CheckFail, err.Error())
+		return
+	}
+	info, err := os.Stat(dir)
+	if err != nil {
+		d.add(check, CheckFail, err.Error())
+		return
+	}
+	if perm := info.Mode().Perm(); perm != os.ModePerm {
+		d.add(check, CheckFail, fmt.Sprintf("directories in %s get the permissions %s instead of %s", path, perm, os.ModePerm))
+		return
+	}
+
+	err = ioutil.WriteFile(filepath.Join(dir, "test"), []byte("doctor"), 0600)
+	if err != nil {
+		d.add(check, CheckFail, err.Error())
+		return
+	}
+
+	d.add(check, CheckPass, path)
+}
+
+// checkClaim checks, if the claim of the transfer volume is bound, mounted by the peer pod
+// and can be mounted by pods on other nodes
+func (d *doctor) checkClaim(ctx context.Context) {
+	switch {
+	case d.cfg.Transfer.Mode == TransferModeExec:
+		d.add("transfer claim", CheckSkip, "transfer mode exec")
+		return
+	case d.clientset == nil:
+		d.add("transfer claim", CheckSkip, "no kubernetes client")
+		return
+	case d.cfg.TransferVolume.Claim == "":
+		d.add("transfer claim", CheckFail, "claim not configured")
+		return
+	}
+
+	claim := d.cfg.TransferVolume.Claim
+	pvc, err := d.clientset.CoreV1().PersistentVolumeClaims(d.cfg.Namespace).Get(ctx, claim, metav1.GetOptions{})
+	if err != nil {
+		d.add("transfer claim", CheckFail, err.Error())
+		return
+	}
+	if pvc.Status.Phase != apiv1.ClaimBound {
+		d.add("transfer claim", CheckFail, fmt.Sprintf("claim %s is %s", claim, pvc.Status.Phase))
+		return
+	}
+
+	if d.peer != nil && d.cfg.Kubernetes.IsPeerPod() && !isClaimMounted(d.peer, claim) {
+		d.add("transfer claim", CheckFail, fmt.Sprintf("claim %s is not mounted by the peer pod %s", claim, d.peer.Name))
+		return
+	}
+
+	modes := pvc.Status.AccessModes
+	switch {
+	case hasAccessMode(modes, apiv1.ReadWriteMany):
+		d.add("transfer claim", CheckPass, fmt.Sprintf("%s bound to %s", claim, pvc.Spec.VolumeName))
+	case hasAccessMode(modes, apiv1.ReadWriteOnce):
+		d.add("transfer claim", CheckWarn, fmt.Sprintf("%s is ReadWriteOnce, all pods must run on the node of the peer", claim))
+	default:
+		d.add("transfer claim", CheckFail, fmt.Sprintf("%s is not writable, access modes %v", claim, modes))
+	}
+}
+
+// checkImages starts a pod for every configured image and checks, if the image can be pulled
+func (d *doctor) checkImages(ctx context.Context) {
+	images := getConfiguredImages(d.cfg)
+	for _, image := range images {
+		check := "image " + image
+		if d.peer == nil {
+			d.add(check, CheckSkip, "no peer pod")
+			continue
+		}
+
+		err := d.checkImage(ctx, image)
+		if err != nil {
+			d.add(check, CheckFail, err.Error())
+			continue
+		}
+		d.add(check, CheckPass, "")
+	}
+}
+
+// checkImage creates a pod with the image and waits until the image is pulled
+func (d *doctor) checkImage(ctx context.Context, image string) error {
+	ctx, cancel := context.WithTimeout(ctx, d.imageTimeout)
+	defer cancel()
+
+	pod, err := newImageCheckPod(d.cfg, image, d.peer)
+	if err != nil {
+		return err
+	}
+
+	pods := d.clientset.CoreV1().Pods(d.cfg.Namespace)
+	pod, err = pods.Create(ctx, pod, metav1.CreateOptions{})
+	if err != nil {
+		return errors.Wrap(err, "creating pod")
+	}
+	defer cleanupPodSilent(d.cfg, pod)
+
+	watcher := newPodWatcher(pods, pod.Name, func(p *apiv1.Pod) (bool, error) {
+		for _, s := range p.Status.ContainerStatuses {
+			// The container may fail, e.g. if the image has no shell, but the image has been pulled
+			if s.State.Running != nil || s.State.Terminated != nil || s.ImageID != "" {
+				return true, nil
+			}
+			if w := s.State.Waiting; w != nil && imagePullFailures[w.Reason] {
+				return true, fmt.Errorf("%s: %s", w.Reason, w.Message)
+			}
+		}
+
+		return false, getFatalPodState(p, d.cfg.Timeouts.Unschedulable)
+	})
+
+	err = watcher.run(ctx)
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("image not pulled within %s", d.imageTimeout)
+	}
+
+	return err
+}
+
+// newImageCheckPod returns a pod owned by the peer pod, which runs the image with the builder pod template,
+// so image pull secrets and node selectors of the configuration apply
+func newImageCheckPod(cfg Config, image string, peer *apiv1.Pod) (*apiv1.Pod, error) {
+	hash := fmt.Sprintf("%x", sha256.Sum256([]byte(image)))[:nameHashLength]
+	name := sanitizeName(fmt.Sprintf("%s-doctor-%s", peer.Name, hash))
+	info := ChaincodeInfo{
+		Component: "doctor",
+		Instance:  name,
+		MSPID:     getPeerMSPID(),
+		Peer:      peer.Name,
+		Image:     image,
+	}
+
+	limits, err := cfg.Builder.Resources.Limits()
+	if err != nil {
+		return nil, errors.Wrap(err, "getting builder resources")
+	}
+
+	pod := &apiv1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            name,
+			OwnerReferences: getOwnerReferences(peer),
+			Labels:          info.Labels(nil),
+			Annotations:     info.Annotations(nil),
+		},
+		Spec: apiv1.PodSpec{
+			Containers: []apiv1.Container{
+				{
+					Name:            "doctor",
+					Image:           image,
+					ImagePullPolicy: apiv1.PullIfNotPresent,
+					Command:         []string{"/bin/sh", "-c", "exit 0"},
+					Resources:       apiv1.ResourceRequirements{Limits: limits},
+				},
+			},
+			EnableServiceLinks: BoolRef(false),
+			RestartPolicy:      apiv1.RestartPolicyNever,
+		},
+	}
+
+	err = applyPodTemplate(cfg.Builder.PodTemplate, pod)
+	if err != nil {
+		return nil, errors.Wrap(err, "applying builder pod template")
+	}
+
+	return pod, nil
+}
+
+// getRequiredPermissions returns the permissions used by the procedures with the configuration
+func getRequiredPermissions(cfg Config) []permission {
+	perms := []permission{
+		{resource: "pods", verbs: []string{"get", "list", "watch", "create", "delete"}},
+		{resource: "pods", subresource: "log", verbs: []string{"get"}},
+		{resource: "pods", subresource: "status", verbs: []string{"get"}},
+		{resource: "events", verbs: []string{"list"}},
+		{group: "coordination.k8s.io", resource: "leases", verbs: []string{"get", "list", "create", "update", "delete"}},
+	}
+
+	if cfg.Transfer.Mode == TransferModeExec {
+		perms = append(perms, permission{resource: "pods", subresource: "exec", verbs: []string{"create"}})
+	}
+	if cfg.Builder.Kind == BuilderKindJob {
+		perms = append(perms, permission{group: "batch", resource: "jobs", verbs: []string{"get", "list", "create", "delete"}})
+	}
+	switch {
+	case cfg.Launcher.Artifacts != ArtifactsSecret:
+	case cfg.Launcher.Mode == LauncherModeCCaaS && cfg.Launcher.CCaaS.TLS.Enabled:
+		perms = append(perms, permission{resource: "secrets", verbs: []string{"get", "create", "update"}})
+	case cfg.Launcher.Mode != LauncherModeCCaaS:
+		perms = append(perms, permission{resource: "secrets", verbs: []string{"get", "create", "delete"}})
+	}
+	if cfg.Launcher.Mode == LauncherModeCCaaS {
+		perms = append(perms,
+			permission{group: "apps", resource: "deployments", verbs: []string{"get", "create", "update"}},
+			permission{resource: "services", verbs: []string{"get", "create"}},
+		)
+	}
+
+	return perms
+}
+
+// getConfiguredImages returns the images of the configuration including the overrides, sorted and without duplicates
+func getConfiguredImages(cfg Config) []string {
+	unique := map[string]bool{}
+	for _, image := range cfg.Images {
+		unique[image] = true
+	}
+	for i := range cfg.Overrides {
+		for _, image := range cfg.Overrides[i].Images {
+			unique[image] = true
+		}
+	}
+	if cfg.Transfer.Mode == TransferModeExec && cfg.Transfer.Image != "" {
+		unique[cfg.Transfer.Image] = true
+	}
+
+	images := make([]string, 0, len(unique))
+	for image := range unique {
+		images = append(images, image)
+	}
+	sort.Strings(images)
+
+	return images
+}
+
+// isClaimMounted returns true, if the pod has a volume of the claim
+func isClaimMounted(pod *apiv1.Pod, claim string) bool {
+	for _, v := range pod.Spec.Volumes {
+		if v.PersistentVolumeClaim != nil && v.PersistentVolumeClaim.ClaimName == claim {
+			return true
+		}
+	}
+
+	return false
+}
+
+// hasAccessMode returns true, if the access modes contain the mode
+func hasAccessMode(modes []apiv1.PersistentVolumeAccessMode, mode apiv1.PersistentVolumeAccessMode) bool {
+	for _, m := range modes {
+		if m == mode {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,475 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	batchv1 "k8s.io/api/batch/v1"
+	apiv1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	defaultGCTransferAge = 24 * time.Hour
+	defaultGCBuilderAge  = 6 * time.Hour
+	defaultGCLauncherAge = time.Hour
+
+	// managedPodSelector selects the builder and chaincode pods created by k8scc
+	managedPodSelector = "externalcc-type in (builder,launcher)"
+)
+
+// garbageCollector removes the leftovers of procedures, which got killed before they cleaned up
+type garbageCollector struct {
+	cfg     Config
+	targets []gcTarget // namespaces and clusters of the peer, the builder and the chaincode pods
+	peers   map[string]bool
+	dryRun  bool
+
+	transferAge time.Duration // minimum age of unused transfer directories
+	builderAge  time.Duration // minimum age of builder pods and jobs, at least the build timeout
+	launcherAge time.Duration // minimum age of terminated chaincode pods
+}
+
+// gcTarget is a namespace, which contains objects of k8scc
+type gcTarget struct {
+	cfg       Config
+	clientset kubernetes.Interface
+}
+
+// GC removes orphaned builder pods and jobs, terminated chaincode pods and unused transfer directories.
+// It is intended to run periodically, e.g. in a CronJob mounting the transfer volume.
+func GC(ctx context.Context, cfg Config) error {
+	log.Println("Procedure: gc")
+
+	gc := garbageCollector{cfg: cfg, peers: map[string]bool{}}
+	flags := flag.NewFlagSet("gc", flag.ContinueOnError)
+	flags.BoolVar(&gc.dryRun, "dry-run", false, "only log what would be removed")
+	flags.DurationVar(&gc.transferAge, "transfer-age", defaultGCTransferAge, "minimum age of unused transfer directories")
+	flags.DurationVar(&gc.builderAge, "builder-age", defaultGCBuilderAge, "minimum age of builder pods and jobs")
+	flags.DurationVar(&gc.launcherAge, "launcher-age", defaultGCLauncherAge, "minimum age of terminated chaincode pods")
+
+	err := flags.Parse(getCommandArgs("gc"))
+	if err != nil {
+		return err
+	}
+
+	// A build may run until its timeout
+	if gc.builderAge < cfg.Timeouts.Build {
+		gc.builderAge = cfg.Timeouts.Build
+	}
+
+	targets, err := cfg.getTargets()
+	if err != nil {
+		return errors.Wrap(err, "getting namespaces of pods")
+	}
+	for _, target := range targets {
+		clientset, err := getKubernetesClientset(target)
+		if err != nil {
+			return errors.Wrap(err, "getting kubernetes clientset")
+		}
+		gc.targets = append(gc.targets, gcTarget{cfg: target, clientset: clientset})
+	}
+
+	for _, target := range gc.targets {
+		held, err := gc.getHeldLeases(ctx, target)
+		if err != nil {
+			return errors.Wrapf(err, "getting leases in namespace %s", target.cfg.Namespace)
+		}
+
+		err = gc.collectJobs(ctx, target, held)
+		if err != nil {
+			return errors.Wrapf(err, "collecting builder jobs in namespace %s", target.cfg.Namespace)
+		}
+
+		err = gc.collectPods(ctx, target, held)
+		if err != nil {
+			return errors.Wrapf(err, "collecting pods in namespace %s", target.cfg.Namespace)
+		}
+
+		err = gc.collectLeases(ctx, target)
+		if err != nil {
+			return errors.Wrapf(err, "collecting leases in namespace %s", target.cfg.Namespace)
+		}
+	}
+
+	// The transfer volume is not used in the transfer mode exec
+	if cfg.Transfer.Mode == TransferModeExec {
+		return nil
+	}
+
+	err = gc.collectTransferDirs(ctx)
+	if err != nil {
+		return errors.Wrap(err, "collecting transfer directories")
+	}
+
+	return nil
+}
+
+// getHeldLeases returns the names of the leases of k8scc, which are held by a running procedure
+func (gc *garbageCollector) getHeldLeases(ctx context.Context, target gcTarget) (map[string]bool, error) {
+	leases, err := target.clientset.CoordinationV1().Leases(target.cfg.Namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: managedLeaseSelector,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	held := map[string]bool{}
+	now := time.Now()
+	for i := range leases.Items {
+		if getLeaseHolder(&leases.Items[i], now) != "" {
+			held[leases.Items[i].Name] = true
+		}
+	}
+
+	return held, nil
+}
+
+// collectJobs removes builder jobs, which are older than any build or whose peer pod is gone.
+// Jobs of builds, which still hold their lease, are kept.
+func (gc *garbageCollector) collectJobs(ctx context.Context, target gcTarget, held map[string]bool) error {
+	jobs, err := target.clientset.BatchV1().Jobs(target.cfg.Namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: "externalcc-type=builder",
+	})
+	if err != nil {
+		return err
+	}
+
+	for i := range jobs.Items {
+		job := &jobs.Items[i]
+		if isBuildRunning(&job.ObjectMeta, held) {
+			continue
+		}
+
+		age := time.Since(job.CreationTimestamp.Time)
+		if age < gc.builderAge && !gc.isPeerGone(ctx, &job.ObjectMeta) {
+			continue
+		}
+
+		gc.remove("job", job.Name, age, func() error {
+			return cleanupJob(target.cfg, job)
+		})
+	}
+
+	return nil
+}
+
+// collectPods removes builder pods, which are older than any build, terminated chaincode pods and pods,
+// whose peer pod is gone. The procedure, which created a pod, deletes it as soon as it terminated.
+// Builder pods of builds, which still hold their lease, are kept.
+func (gc *garbageCollector) collectPods(ctx context.Context, target gcTarget, held map[string]bool) error {
+	pods, err := target.clientset.CoreV1().Pods(target.cfg.Namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: managedPodSelector,
+	})
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		if isOwnedByJob(pod) || pod.DeletionTimestamp != nil || isBuildRunning(&pod.ObjectMeta, held) {
+			continue // removed together with the job, already terminating or still building
+		}
+
+		if !gc.isOrphaned(pod, now) && !gc.isPeerGone(ctx, &pod.ObjectMeta) {
+			continue
+		}
+
+		age := now.Sub(pod.CreationTimestamp.Time)
+		gc.remove("pod", pod.Name, age, func() error {
+			return deletePod(target.clientset, target.cfg, pod)
+		})
+	}
+
+	return nil
+}
+
+// isOrphaned returns true, if the builder pod is older than any build or the pod terminated long ago
+func (gc *garbageCollector) isOrphaned(pod *apiv1.Pod, now time.Time) bool {
+	age := now.Sub(pod.CreationTimestamp.Time)
+	terminated := pod.Status.Phase == apiv1.PodSucceeded || pod.Status.Phase == apiv1.PodFailed
+
+	switch pod.Labels["externalcc-type"] {
+	case ComponentBuilder:
+		return age >= gc.builderAge || (terminated && age >= gc.launcherAge)
+	case ComponentLauncher:
+		return terminated && age >= gc.launcherAge
+	}
+
+	return false
+}
+
+// isBuildRunning returns true, if the lease of the build, which created the builder pod or job, is held
+func isBuildRunning(obj *metav1.ObjectMeta, held map[string]bool) bool {
+	name := obj.Annotations[buildLeaseAnnotation]
+	return name != "" && held[name]
+}
+
+// collectLeases removes expired leases, which were not released by a killed procedure
+func (gc *garbageCollector) collectLeases(ctx context.Context, target gcTarget) error {
+	leases := target.clientset.CoordinationV1().Leases(target.cfg.Namespace)
+	list, err := leases.List(ctx, metav1.ListOptions{LabelSelector: managedLeaseSelector})
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for i := range list.Items {
+		l := &list.Items[i]
+		if getLeaseHolder(l, now) != "" {
+			continue
+		}
+
+		age := time.Since(l.CreationTimestamp.Time)
+		gc.remove("lease", l.Name, age, func() error {
+			// The lease is not removed, if it got acquired in the meantime
+			uid, resourceVersion := l.UID, l.ResourceVersion
+			return leases.Delete(ctx, l.Name, metav1.DeleteOptions{
+				Preconditions: &metav1.Preconditions{UID: &uid, ResourceVersion: &resourceVersion},
+			})
+		})
+	}
+
+	return nil
+}
+
+// collectTransferDirs removes directories on the transfer volume, which are not used by any pod
+func (gc *garbageCollector) collectTransferDirs(ctx context.Context) error {
+	used, err := gc.getUsedTransferDirs(ctx)
+	if err != nil {
+		return errors.Wrap(err, "getting transfer directories used by pods")
+	}
+
+	root := gc.cfg.TransferVolume.Path
+	cacheDir := gc.cfg.Builder.Cache.Path
+	if cacheDir == "" {
+		cacheDir = filepath.Join(root, "cache")
+	}
+
+	// Transfer directories of builds and chaincodes, and the persistent directories of chaincodes as a service.
+	// The build cache and the shared builds are cleaned below.
+	excluded := []string{"builds", "cache", "ccaas", "lost+found"}
+	if filepath.Dir(filepath.Clean(cacheDir)) == filepath.Clean(root) {
+		excluded = append(excluded, filepath.Base(cacheDir))
+	}
+	candidates, err := listDirs(root, excluded...)
+	if err != nil {
+		return err
+	}
+	ccaasDirs, err := listDirs(filepath.Join(root, "ccaas"))
+	if err != nil && !os.IsNotExist(errors.Cause(err)) {
+		return err
+	}
+	candidates = append(candidates, ccaasDirs...)
+
+	for _, dir := range candidates {
+		rel, err := filepath.Rel(root, dir.path)
+		if err != nil {
+			return err
+		}
+
+		age := time.Since(dir.modTime)
+		if age < gc.transferAge || used[filepath.ToSlash(rel)] {
+			continue
+		}
+
+		path := dir.path
+		gc.remove("transfer directory", rel, age, func() error {
+			return os.RemoveAll(path)
+		})
+	}
+
+	// Temporary entries of the build cache, which were not moved into place
+	tmpEntries, err := listDirs(cacheDir)
+	if err != nil && !os.IsNotExist(errors.Cause(err)) {
+		return err
+	}
+	for _, dir := range tmpEntries {
+		age := time.Since(dir.modTime)
+		if !strings.HasPrefix(filepath.Base(dir.path), ".tmp-") || age < gc.transferAge {
+			continue
+		}
+
+		path := dir.path
+		gc.remove("temporary cache entry", filepath.Base(path), age, func() error {
+			return os.RemoveAll(path)
+		})
+	}
+
+	// Outputs of builds shared with concurrent builds and the markers of the waiting builds, if the build cache is disabled
+	builds, err := listDirs(filepath.Join(root, "builds"))
+	if err != nil && !os.IsNotExist(errors.Cause(err)) {
+		return err
+	}
+	for _, dir := range builds {
+		age := time.Since(dir.modTime)
+		if age < gc.transferAge {
+			continue
+		}
+
+		path := dir.path
+		gc.remove("shared build", filepath.Base(path), age, func() error {
+			return os.RemoveAll(path)
+		})
+	}
+
+	return nil
+}
+
+// getUsedTransferDirs returns the directories of the transfer volume, which are mounted in a pod,
+// e.g. the directory of a running chaincode or the persistent directory of a chaincode as a service
+func (gc *garbageCollector) getUsedTransferDirs(ctx context.Context) (map[string]bool, error) {
+	used := map[string]bool{}
+	for _, target := range gc.targets {
+		err := gc.addUsedTransferDirs(ctx, target, used)
+		if err != nil {
+			return nil, errors.Wrapf(err, "namespace %s", target.cfg.Namespace)
+		}
+	}
+
+	return used, nil
+}
+
+// addUsedTransferDirs adds the transfer directories used by the pods and deployments of the target
+func (gc *garbageCollector) addUsedTransferDirs(ctx context.Context, target gcTarget, used map[string]bool) error {
+	pods, err := target.clientset.CoreV1().Pods(target.cfg.Namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+
+	for i := range pods.Items {
+		spec := &pods.Items[i].Spec
+		containers := append(spec.InitContainers, spec.Containers...) // nolint:gocritic
+		for _, c := range containers {
+			for _, m := range c.VolumeMounts {
+				if m.Name != transferVolumeName || m.SubPath == "" {
+					continue
+				}
+
+				// The sub paths are <dir>/src/, <dir>/output/ or ccaas/<name>/output/
+				parts := strings.Split(strings.Trim(m.SubPath, "/"), "/")
+				for n := 1; n <= len(parts); n++ {
+					used[strings.Join(parts[:n], "/")] = true
+				}
+			}
+		}
+	}
+
+	// Chaincodes as a service may be scaled down, their directory is used as long as the deployment exists
+	deployments, err := target.clientset.AppsV1().Deployments(target.cfg.Namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: "externalcc-type=" + ComponentCCaaS,
+	})
+	if err != nil {
+		return err
+	}
+	for i := range deployments.Items {
+		used["ccaas/"+deployments.Items[i].Name] = true
+	}
+
+	return nil
+}
+
+// isPeerGone returns true, if the object is linked to its peer pod by labels instead of an owner reference
+// and the peer pod does not exist anymore. Objects in the namespace of the peer are deleted together with it.
+func (gc *garbageCollector) isPeerGone(ctx context.Context, obj *metav1.ObjectMeta) bool {
+	uid := obj.Labels[metadataPrefix+"peer-uid"]
+	name := obj.Labels[metadataPrefix+"peer"]
+	namespace := obj.Labels[metadataPrefix+"peer-namespace"]
+	if len(obj.OwnerReferences) > 0 || uid == "" || name == "" || namespace == "" {
+		return false
+	}
+
+	if gone, ok := gc.peers[uid]; ok {
+		return gone
+	}
+
+	// Only the peers in the namespace and cluster of this process are known
+	peerCfg := gc.cfg.forPeer()
+	if namespace != peerCfg.Namespace {
+		return false
+	}
+	clientset, err := getKubernetesClientset(peerCfg)
+	if err != nil {
+		return false
+	}
+
+	peer, err := clientset.CoreV1().Pods(namespace).Get(ctx, name, metav1.GetOptions{})
+	switch {
+	case k8serrors.IsNotFound(err):
+		gc.peers[uid] = true
+	case err != nil:
+		log.Printf("Getting peer pod %s of %s: %s", name, obj.Name, err)
+		return false
+	default:
+		gc.peers[uid] = string(peer.UID) != uid
+	}
+
+	return gc.peers[uid]
+}
+
+// remove logs the removal of the object and removes it, unless it is a dry run
+func (gc *garbageCollector) remove(kind, name string, age time.Duration, remove func() error) {
+	if gc.dryRun {
+		log.Printf("Would remove %s %s, age %s (dry run)", kind, name, age.Round(time.Second))
+		return
+	}
+
+	log.Printf("Removing %s %s, age %s", kind, name, age.Round(time.Second))
+	err := remove()
+	if err != nil {
+		log.Printf("Removing %s %s failed: %s", kind, name, err)
+	}
+}
+
+// isOwnedByJob returns true, if the pod is created by a job
+func isOwnedByJob(pod *apiv1.Pod) bool {
+	for _, ref := range pod.OwnerReferences {
+		if ref.Kind == "Job" && ref.APIVersion == batchv1.SchemeGroupVersion.String() {
+			return true
+		}
+	}
+
+	return false
+}
+
+// dirEntry is a directory found by listDirs
+type dirEntry struct {
+	path    string
+	modTime time.Time
+}
+
+// listDirs returns the subdirectories of dir except the excluded ones
+func listDirs(dir string, exclude ...string) ([]dirEntry, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "listing %s", dir)
+	}
+
+	excluded := map[string]bool{}
+	for _, name := range exclude {
+		excluded[name] = true
+	}
+
+	dirs := []dirEntry{}
+	for _, f := range files {
+		if !f.IsDir() || excluded[f.Name()] {
+			continue
+		}
+		dirs = append(dirs, dirEntry{
+			path:    filepath.Join(dir, f.Name()),
+			modTime: f.ModTime(),
+		})
+	}
+
+	return dirs, nil
+}
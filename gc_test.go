@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestCollectPods(t *testing.T) {
+	now := time.Now()
+	builder := map[string]string{"externalcc-type": ComponentBuilder}
+	launcher := map[string]string{"externalcc-type": ComponentLauncher}
+
+	pods := []apiv1.Pod{
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "running-builder", Labels: builder, CreationTimestamp: metav1.Time{Time: now.Add(-time.Hour)}},
+			Status:     apiv1.PodStatus{Phase: apiv1.PodRunning},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "builder-older-than-any-build", Labels: builder, CreationTimestamp: metav1.Time{Time: now.Add(-7 * time.Hour)}},
+			Status:     apiv1.PodStatus{Phase: apiv1.PodRunning},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "terminated-builder", Labels: builder, CreationTimestamp: metav1.Time{Time: now.Add(-2 * time.Hour)}},
+			Status:     apiv1.PodStatus{Phase: apiv1.PodFailed},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "recently-terminated-builder", Labels: builder, CreationTimestamp: metav1.Time{Time: now.Add(-10 * time.Minute)}},
+			Status:     apiv1.PodStatus{Phase: apiv1.PodSucceeded},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:              "builder-of-running-build",
+				Labels:            builder,
+				Annotations:       map[string]string{buildLeaseAnnotation: "k8scc-build-held"},
+				CreationTimestamp: metav1.Time{Time: now.Add(-7 * time.Hour)},
+			},
+			Status: apiv1.PodStatus{Phase: apiv1.PodRunning},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:              "builder-of-expired-build",
+				Labels:            builder,
+				Annotations:       map[string]string{buildLeaseAnnotation: "k8scc-build-expired"},
+				CreationTimestamp: metav1.Time{Time: now.Add(-7 * time.Hour)},
+			},
+			Status: apiv1.PodStatus{Phase: apiv1.PodRunning},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "running-chaincode", Labels: launcher, CreationTimestamp: metav1.Time{Time: now.Add(-48 * time.Hour)}},
+			Status:     apiv1.PodStatus{Phase: apiv1.PodRunning},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "terminated-chaincode", Labels: launcher, CreationTimestamp: metav1.Time{Time: now.Add(-2 * time.Hour)}},
+			Status:     apiv1.PodStatus{Phase: apiv1.PodSucceeded},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "recently-terminated-chaincode", Labels: launcher, CreationTimestamp: metav1.Time{Time: now.Add(-10 * time.Minute)}},
+			Status:     apiv1.PodStatus{Phase: apiv1.PodFailed},
+		},
+	}
+	held := map[string]bool{"k8scc-build-held": true}
+	want := []string{"builder-of-expired-build", "builder-older-than-any-build", "terminated-builder", "terminated-chaincode"}
+
+	clientset := fake.NewSimpleClientset()
+	for i := range pods {
+		pods[i].Namespace = "fabric"
+		if _, err := clientset.CoreV1().Pods("fabric").Create(context.Background(), &pods[i], metav1.CreateOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	gc := garbageCollector{builderAge: 6 * time.Hour, launcherAge: time.Hour, peers: map[string]bool{}}
+	target := gcTarget{cfg: Config{Namespace: "fabric"}, clientset: clientset}
+	err := gc.collectPods(context.Background(), target, held)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deleted := []string{}
+	for _, a := range clientset.Actions() {
+		if d, ok := a.(k8stesting.DeleteAction); ok && d.GetResource().Resource == "pods" {
+			deleted = append(deleted, d.GetName())
+		}
+	}
+	sort.Strings(deleted)
+	if !reflect.DeepEqual(deleted, want) {
+		t.Errorf("deleted pods = %v, want %v", deleted, want)
+	}
+}
@@ -17,6 +17,7 @@ require (
 	github.com/sykesm/zap-logfmt v0.0.3 // indirect
 	google.golang.org/grpc v1.56.3 // indirect
 	gopkg.in/yaml.v2 v2.3.0
+	gopkg.in/yaml.v3 v3.0.1
 	k8s.io/api v0.20.0
 	k8s.io/apimachinery v0.20.0
 	k8s.io/client-go v0.20.0
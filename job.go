@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+	batchv1 "k8s.io/api/batch/v1"
+	apiv1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+)
+
+const (
+	// BuilderKindPod builds the chaincode in a bare Pod
+	BuilderKindPod = "pod"
+	// BuilderKindJob builds the chaincode in a Job, which retries failed or evicted builder pods
+	BuilderKindJob = "job"
+
+	jobPollPeriod = 2 * time.Second
+)
+
+// JobConfig defines the Job of the builder kind job
+type JobConfig struct {
+	BackoffLimit     *int32         `yaml:"backoff_limit"`      // retries of failed pods, Kubernetes defaults to 6
+	ActiveDeadline   time.Duration  `yaml:"active_deadline"`    // maximum duration of the job including retries
+	TTLAfterFinished *time.Duration `yaml:"ttl_after_finished"` // removes finished jobs, which are not cleaned up by the peer
+}
+
+// runBuilderJob builds the chaincode in a Job and returns the builder image
+func runBuilderJob(ctx context.Context, cfg Config, metadata *ChaincodeMetadata, transferPVPrefix string) (string, error) {
+	// Create builder Job
+	job, err := createBuilderJob(ctx, cfg, metadata, transferPVPrefix)
+	if err != nil {
+		return "", errors.Wrap(err, "creating builder job")
+	}
+	defer cleanupJobSilent(cfg, job)
+
+	// Watch builder Job for completion or failure
+	err = watchJobUntilCompletion(ctx, cfg, job)
+	if err != nil {
+		return "", errors.Wrapf(err, "build of Chaincode %s in Job %s failed", metadata.Label, job.Name)
+	}
+
+	return job.Spec.Template.Spec.Containers[0].Image, nil
+}
+
+func createBuilderJob(ctx context.Context,
+	cfg Config, metadata *ChaincodeMetadata, transferPVPrefix string) (*batchv1.Job, error) {
+	// Setup kubernetes client
+	clientset, err := getKubernetesClientset(cfg)
+	if err != nil {
+		return nil, errors.Wrap(err, "getting kubernetes clientset")
+	}
+
+	peer, err := getPeerPod(ctx, cfg)
+	if err != nil {
+		return nil, errors.Wrap(err, "getting myself Pod")
+	}
+
+	job, err := newBuilderJob(cfg, metadata, transferPVPrefix, peer)
+	if err != nil {
+		return nil, err
+	}
+
+	return clientset.BatchV1().Jobs(cfg.Namespace).Create(ctx, job, metav1.CreateOptions{})
+}
+
+// newBuilderJob returns the builder job owned by the peer pod
+func newBuilderJob(cfg Config, metadata *ChaincodeMetadata, transferPVPrefix string, peer *apiv1.Pod) (*batchv1.Job, error) {
+	// The builder pod is the template of the Job, its pods are owned by the Job
+	pod, err := newBuilderPod(cfg, metadata, transferPVPrefix, peer)
+	if err != nil {
+		return nil, err
+	}
+
+	job := &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            pod.Name,
+			OwnerReferences: pod.OwnerReferences,
+			Labels:          pod.Labels,
+			Annotations:     pod.Annotations,
+		},
+		Spec: batchv1.JobSpec{
+			BackoffLimit: cfg.Builder.Job.BackoffLimit,
+			Template: apiv1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels:      pod.Labels,
+					Annotations: pod.Annotations,
+				},
+				Spec: pod.Spec,
+			},
+		},
+	}
+	// A retry must not see the partial output of a failed pod on the transfer volume
+	addOutputCleanup(&job.Spec.Template.Spec)
+	if d := cfg.Builder.Job.ActiveDeadline; d > 0 {
+		job.Spec.ActiveDeadlineSeconds = Int64Ref(int64(d.Seconds()))
+	}
+	if ttl := cfg.Builder.Job.TTLAfterFinished; ttl != nil {
+		job.Spec.TTLSecondsAfterFinished = Int32Ref(int32(ttl.Seconds()))
+	}
+
+	return job, nil
+}
+
+// addOutputCleanup empties the output directory of the builder in an init container before every attempt
+func addOutputCleanup(spec *apiv1.PodSpec) {
+	container := spec.Containers[0]
+	for _, m := range container.VolumeMounts {
+		if m.MountPath != "/chaincode/output/" {
+			continue
+		}
+		spec.InitContainers = append([]apiv1.Container{{
+			Name:            "cleanup",
+			Image:           container.Image,
+			ImagePullPolicy: container.ImagePullPolicy,
+			Command: []string{
+				"/bin/sh", "-c", "rm -rf /chaincode/output/* /chaincode/output/.[!.]* /chaincode/output/..?*",
+			},
+			Resources:       container.Resources,
+			SecurityContext: container.SecurityContext,
+			VolumeMounts:    []apiv1.VolumeMount{m},
+		}}, spec.InitContainers...)
+	}
+}
+
+// watchJobUntilCompletion follows the pods of the job one after the other until the job completes or fails.
+// Failed and deleted pods are replaced by the job controller, other failures like timeouts are returned.
+func watchJobUntilCompletion(ctx context.Context, cfg Config, job *batchv1.Job) error {
+	// Setup kubernetes client
+	clientset, err := getKubernetesClientset(cfg)
+	if err != nil {
+		return errors.Wrap(err, "getting kubernetes clientset")
+	}
+	jobs := clientset.BatchV1().Jobs(job.Namespace)
+	pods := clientset.CoreV1().Pods(job.Namespace)
+	selector := labels.Set{"controller-uid": string(job.UID)}.AsSelector().String()
+
+	ticker := time.NewTicker(jobPollPeriod)
+	defer ticker.Stop()
+
+	watched := map[string]bool{}
+	var lastErr error
+	for {
+		j, err := jobs.Get(ctx, job.Name, metav1.GetOptions{})
+		switch {
+		case ctx.Err() != nil:
+			return ctx.Err()
+		case k8serrors.IsNotFound(err):
+			return errors.New("job got deleted")
+		case err != nil:
+			return errors.Wrap(err, "getting job")
+		}
+
+		if done, err := getJobResult(j, lastErr); done {
+			return err
+		}
+
+		// Follow the next pod of the job
+		pod, err := getNextJobPod(ctx, pods, selector, watched)
+		if err != nil {
+			return errors.Wrap(err, "listing pods of job")
+		}
+		if pod != nil {
+			watched[pod.Name] = true
+			err = watchPodUntilCompletion(ctx, cfg, pod)
+			if err == nil || ctx.Err() != nil || !isPodReplaced(ctx, pods, pod.Name) {
+				return err
+			}
+
+			log.Printf("Pod %s of job %s failed, waiting for a retry: %s", pod.Name, job.Name, err)
+			lastErr = err
+			continue
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// getJobResult returns done, if the job completed or failed
+func getJobResult(job *batchv1.Job, lastErr error) (bool, error) {
+	for _, c := range job.Status.Conditions {
+		if c.Status != apiv1.ConditionTrue {
+			continue
+		}
+
+		switch c.Type {
+		case batchv1.JobComplete:
+			return true, nil
+		case batchv1.JobFailed:
+			err := fmt.Errorf("job failed: %s: %s", c.Reason, c.Message)
+			if lastErr != nil {
+				err = fmt.Errorf("%s; last pod failed: %s", err, lastErr)
+			}
+			return true, err
+		}
+	}
+
+	return false, nil
+}
+
+// getNextJobPod returns the oldest pod of the job, which was not watched yet, or nil
+func getNextJobPod(ctx context.Context,
+	pods typedcorev1.PodInterface, selector string, watched map[string]bool) (*apiv1.Pod, error) {
+	list, err := pods.List(ctx, metav1.ListOptions{LabelSelector: selector})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(list.Items, func(i, j int) bool {
+		return list.Items[i].CreationTimestamp.Before(&list.Items[j].CreationTimestamp)
+	})
+
+	for i := range list.Items {
+		if !watched[list.Items[i].Name] {
+			return &list.Items[i], nil
+		}
+	}
+
+	return nil, nil
+}
+
+// isPodReplaced returns true, if the job controller replaces the pod, because it failed or got deleted
+func isPodReplaced(ctx context.Context, pods typedcorev1.PodInterface, name string) bool {
+	p, err := pods.Get(ctx, name, metav1.GetOptions{})
+	if k8serrors.IsNotFound(err) {
+		return true
+	}
+
+	return err == nil && (p.Status.Phase == apiv1.PodFailed || p.DeletionTimestamp != nil)
+}
+
+func cleanupJobSilent(cfg Config, job *batchv1.Job) {
+	err := cleanupJob(cfg, job)
+	log.Println(err)
+}
+
+// cleanupJob deletes the job including its pods
+func cleanupJob(cfg Config, job *batchv1.Job) error {
+	clientset, err := getKubernetesClientset(cfg)
+	if err != nil {
+		return errors.Wrap(err, "getting kubernetes clientset")
+	}
+
+	// The context of the procedure may be cancelled already
+	ctx := context.Background()
+	propagation := metav1.DeletePropagationBackground
+	opts := metav1.DeleteOptions{PropagationPolicy: &propagation}
+	if grace := cfg.Timeouts.DeletionGracePeriod; grace != nil {
+		opts.GracePeriodSeconds = Int64Ref(int64(grace.Seconds()))
+	}
+
+	return clientset.BatchV1().Jobs(job.Namespace).Delete(ctx, job.Name, opts)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// KubernetesConfig defines the connection to Kubernetes. Without kubeconfig, the in-cluster
+// configuration of the service account of the peer pod is used.
+type KubernetesConfig struct {
+	Kubeconfig string `yaml:"kubeconfig"` // path of a kubeconfig, e.g. if the peer runs outside of Kubernetes
+	Context    string `yaml:"context"`    // context of the kubeconfig, defaults to its current context
+	Namespace  string `yaml:"namespace"`  // defaults to the namespace of the context or of the service account
+	PeerPod    *bool  `yaml:"peer_pod"`   // the peer runs in a pod, which owns the created objects, defaults to true in-cluster
+}
+
+// WithEnv returns the configuration with the values of the environment variables
+// K8SCC_KUBECONFIG, K8SCC_KUBECONTEXT and K8SCC_NAMESPACE, which are not configured
+func (k KubernetesConfig) WithEnv() KubernetesConfig {
+	if k.Kubeconfig == "" {
+		k.Kubeconfig = os.Getenv("K8SCC_KUBECONFIG")
+	}
+	if k.Context == "" {
+		k.Context = os.Getenv("K8SCC_KUBECONTEXT")
+	}
+	if k.Namespace == "" {
+		k.Namespace = os.Getenv("K8SCC_NAMESPACE")
+	}
+
+	return k
+}
+
+// InCluster returns true, if the in-cluster configuration is used
+func (k KubernetesConfig) InCluster() bool {
+	return k.Kubeconfig == ""
+}
+
+// IsPeerPod returns true, if the peer runs in a pod of the cluster
+func (k KubernetesConfig) IsPeerPod() bool {
+	if k.PeerPod != nil {
+		return *k.PeerPod
+	}
+
+	return k.InCluster()
+}
+
+// clientConfig returns the client configuration of the kubeconfig and context
+func (k KubernetesConfig) clientConfig() clientcmd.ClientConfig {
+	return clientcmd.NewNonInteractiveDeferredLoadingClientConfig(
+		&clientcmd.ClientConfigLoadingRules{ExplicitPath: k.Kubeconfig},
+		&clientcmd.ConfigOverrides{CurrentContext: k.Context},
+	)
+}
+
+// errNoNamespace is returned in-cluster, if neither the configuration nor the service account provides the namespace
+var errNoNamespace = errors.New("no namespace configured") // nolint:gochecknoglobals
+
+// getNamespace returns the configured namespace, the namespace of the kubeconfig context or the
+// namespace of the service account. In-cluster, it returns errNoNamespace, if the namespace is not available.
+func getNamespace(k KubernetesConfig) (string, error) {
+	if k.Namespace != "" {
+		return k.Namespace, nil
+	}
+
+	if !k.InCluster() {
+		namespace, _, err := k.clientConfig().Namespace()
+		return namespace, errors.Wrapf(err, "getting namespace of kubeconfig %s", k.Kubeconfig)
+	}
+
+	namespace, err := ioutil.ReadFile(namespaceFile)
+	if err != nil && !os.IsNotExist(err) {
+		return "", errors.Wrapf(err, "reading namespace file %s", namespaceFile)
+	}
+	if strings.TrimSpace(string(namespace)) == "" {
+		return "", errors.Wrapf(errNoNamespace, "%s is missing or empty", namespaceFile)
+	}
+
+	return strings.TrimSpace(string(namespace)), nil
+}
+
+func getKubernetesConfig(cfg Config) (*rest.Config, error) {
+	k := cfg.Kubernetes
+	if k.InCluster() {
+		config, err := rest.InClusterConfig()
+		return config, errors.Wrap(err, "getting kubernetes in-cluster config")
+	}
+
+	config, err := k.clientConfig().ClientConfig()
+	return config, errors.Wrapf(err, "loading kubeconfig %s", k.Kubeconfig)
+}
+
+func getKubernetesClientset(cfg Config) (*kubernetes.Clientset, error) {
+	// Setup kubernetes client
+	config, err := getKubernetesConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	clientset, err := kubernetes.NewForConfig(config)
+	return clientset, errors.Wrap(err, "creating kubernetes client")
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+const testKubeconfig = `apiVersion: v1
+kind: Config
+clusters:
+- name: test
+  cluster:
+    server: https://127.0.0.1:6443
+users:
+- name: test
+  user:
+    token: test
+contexts:
+- name: fabric
+  context:
+    cluster: test
+    user: test
+    namespace: fabric
+- name: plain
+  context:
+    cluster: test
+    user: test
+current-context: fabric
+`
+
+func TestGetNamespace(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "k8scc-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	kubeconfig := filepath.Join(tmp, "kubeconfig")
+	if err := ioutil.WriteFile(kubeconfig, []byte(testKubeconfig), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		k    KubernetesConfig
+		want string
+	}{
+		{name: "configured", k: KubernetesConfig{Kubeconfig: kubeconfig, Namespace: "peers"}, want: "peers"},
+		{name: "current context", k: KubernetesConfig{Kubeconfig: kubeconfig}, want: "fabric"},
+		{name: "context without namespace", k: KubernetesConfig{Kubeconfig: kubeconfig, Context: "plain"}, want: "default"},
+		{name: "configured in-cluster", k: KubernetesConfig{Namespace: "peers"}, want: "peers"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := getNamespace(tt.k)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("getNamespace() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetNamespaceInClusterWithoutServiceAccount(t *testing.T) {
+	if _, err := os.Stat(namespaceFile); err == nil {
+		t.Skipf("%s exists", namespaceFile)
+	}
+
+	_, err := getNamespace(KubernetesConfig{})
+	if errors.Cause(err) != errNoNamespace {
+		t.Errorf("getNamespace() = %v, want %v", err, errNoNamespace)
+	}
+}
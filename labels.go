@@ -0,0 +1,127 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+const (
+	// metadataPrefix is the prefix of the labels and annotations, which describe the chaincode
+	metadataPrefix = "k8scc.postfinance.ch/"
+
+	// ComponentBuilder, ComponentLauncher and ComponentCCaaS are the values of the label externalcc-type
+	ComponentBuilder  = "builder"
+	ComponentLauncher = "launcher"
+	ComponentCCaaS    = "ccaas"
+
+	// buildLeaseAnnotation is the name of the lease held during the build, which created the builder pod or job
+	buildLeaseAnnotation = metadataPrefix + "build-lease"
+)
+
+// version of k8scc, set at build time with -ldflags "-X main.version=..."
+var version = "dev" // nolint:gochecknoglobals
+
+// invalidLabelValueChars matches all characters, which are not allowed in a label value
+var invalidLabelValueChars = regexp.MustCompile(`[^A-Za-z0-9._-]`) // nolint:gochecknoglobals
+
+// ChaincodeInfo describes the chaincode of a builder or chaincode pod. Empty values are omitted.
+type ChaincodeInfo struct {
+	Component     string // builder, launcher or ccaas
+	Instance      string // name of the pod or deployment
+	CCID          string // chaincode ID, which is the package ID
+	Label         string // label of the chaincode
+	MSPID         string // MSP ID of the peer
+	Peer          string // name of the peer pod
+	PeerNamespace string // namespace of the peer pod
+	PeerUID       string // UID of the peer pod, which links pods in other namespaces to the peer
+	PeerAddress   string // address of the peer, the chaincode connects to
+	Platform      string // golang, java, node, k8s
+	Image         string // image of the builder or chaincode
+	SourceHash    string // hash of the chaincode source
+	BuildLease    string // name of the lease held during the build, which created the builder pod
+}
+
+// Labels returns the labels to select the pods per chaincode and per peer, the extra labels of the configuration included
+func (i *ChaincodeInfo) Labels(extra map[string]string) map[string]string {
+	labels := make(map[string]string, len(extra)+14)
+	for key, value := range extra {
+		labels[key] = value
+	}
+
+	set := func(key, value string) {
+		if value != "" {
+			labels[key] = sanitizeLabelValue(value)
+		}
+	}
+
+	set("externalcc-type", i.Component)
+	set("app.kubernetes.io/name", "chaincode")
+	set("app.kubernetes.io/instance", i.Instance)
+	set("app.kubernetes.io/component", i.Component)
+	set("app.kubernetes.io/part-of", "hyperledger-fabric")
+	set("app.kubernetes.io/managed-by", "hlfabric-k8scc")
+	set(metadataPrefix+"chaincode-label", i.Label)
+	set(metadataPrefix+"package-hash", i.PackageHash())
+	set(metadataPrefix+"mspid", i.MSPID)
+	set(metadataPrefix+"peer", i.Peer)
+	set(metadataPrefix+"peer-namespace", i.PeerNamespace)
+	set(metadataPrefix+"peer-uid", i.PeerUID)
+	set(metadataPrefix+"platform", i.Platform)
+	set(metadataPrefix+"version", version)
+
+	return labels
+}
+
+// Annotations returns the annotations with the values, which are not suitable as labels, the extra annotations included
+func (i *ChaincodeInfo) Annotations(extra map[string]string) map[string]string {
+	annotations := make(map[string]string, len(extra)+5)
+	for key, value := range extra {
+		annotations[key] = value
+	}
+
+	set := func(key, value string) {
+		if value != "" {
+			annotations[key] = value
+		}
+	}
+
+	set(metadataPrefix+"ccid", i.CCID)
+	set(metadataPrefix+"peer-address", i.PeerAddress)
+	set(metadataPrefix+"image-digest", getImageDigest(i.Image))
+	set(metadataPrefix+"source-hash", i.SourceHash)
+	set(buildLeaseAnnotation, i.BuildLease)
+
+	return annotations
+}
+
+// PackageHash returns the short hash of the chaincode package, which is also part of the pod names.
+// The full hash is longer than the maximum length of a label value and available in the annotation ccid.
+func (i *ChaincodeInfo) PackageHash() string {
+	parts := strings.SplitN(i.CCID, ":", 2)
+	if len(parts) != 2 || len(parts[1]) < nameHashLength {
+		return ""
+	}
+
+	return parts[1][:nameHashLength]
+}
+
+// getImageDigest returns the digest of an image reference, if it is pinned to a digest
+func getImageDigest(image string) string {
+	i := strings.LastIndex(image, "@")
+	if i < 0 {
+		return ""
+	}
+
+	return image[i+1:]
+}
+
+// sanitizeLabelValue converts the value into a valid label value. Values, which are too long, are
+// truncated and get a hash of the full value as suffix.
+func sanitizeLabelValue(value string) string {
+	sanitized := invalidLabelValueChars.ReplaceAllString(value, "-")
+	sanitized = strings.Trim(sanitized, "-_.")
+
+	return truncateWithHash(sanitized, value, validation.LabelValueMaxLength, "-_.")
+}
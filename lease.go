@@ -0,0 +1,372 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	typedcoordinationv1 "k8s.io/client-go/kubernetes/typed/coordination/v1"
+)
+
+// managedLeaseSelector selects the leases created by k8scc
+const managedLeaseSelector = "app.kubernetes.io/managed-by=hlfabric-k8scc"
+
+const (
+	leaseDuration    = 30 * time.Second // a lease expires, if its holder does not renew it, e.g. after being killed
+	leaseRenewPeriod = 10 * time.Second
+	leasePollPeriod  = 2 * time.Second
+	leaseLogPeriod   = 30 * time.Second
+	slotPollPeriod   = 5 * time.Second // many builds may wait for a slot, so the slots are polled less often
+
+	// leaseKindLabel distinguishes the leases of builds and the slots of builder pods
+	leaseKindLabel   = metadataPrefix + "lease"
+	leaseKindBuild   = "build"
+	leaseKindBuilder = "builder-slot"
+)
+
+// errLeaseLost is returned, when another procedure took over the lease or deleted it
+var errLeaseLost = errors.New("lease got lost") // nolint:gochecknoglobals
+
+// lease is a coordination.k8s.io Lease, which is held by at most one procedure at a time.
+// The holder renews the lease in the background until it releases it or loses it.
+type lease struct {
+	leases      typedcoordinationv1.LeaseInterface
+	name        string
+	holder      string
+	labels      map[string]string
+	duration    time.Duration
+	renewPeriod time.Duration
+
+	current *coordinationv1.Lease // state of the last acquisition or renewal
+	lost    chan struct{}         // closed, when the lease got lost while it was held
+	cancel  context.CancelFunc
+	done    chan struct{}
+}
+
+// newLease returns the lease with the name in the namespace of the configuration
+func newLease(cfg Config, name string, labels map[string]string) (*lease, error) {
+	leases, err := newLeases(cfg, []string{name}, labels)
+	if err != nil {
+		return nil, err
+	}
+
+	return leases[0], nil
+}
+
+// newLeases returns the leases with the names in the namespace of the configuration
+func newLeases(cfg Config, names []string, labels map[string]string) ([]*lease, error) {
+	clientset, err := getKubernetesClientset(cfg)
+	if err != nil {
+		return nil, errors.Wrap(err, "getting kubernetes clientset")
+	}
+
+	myself, _ := os.Hostname()
+	holder := fmt.Sprintf("%s-%d", myself, os.Getpid())
+	leases := make([]*lease, 0, len(names))
+	for _, name := range names {
+		leases = append(leases, newLeaseWithClient(clientset.CoordinationV1().Leases(cfg.Namespace), name, holder, labels))
+	}
+
+	return leases, nil
+}
+
+// newLeaseWithClient returns the lease with the name held by the holder
+func newLeaseWithClient(leases typedcoordinationv1.LeaseInterface, name, holder string, labels map[string]string) *lease {
+	return &lease{
+		leases:      leases,
+		name:        name,
+		holder:      holder,
+		labels:      labels,
+		duration:    leaseDuration,
+		renewPeriod: leaseRenewPeriod,
+	}
+}
+
+// acquire waits until the lease is acquired or the context is canceled. The holder is logged while waiting.
+func (l *lease) acquire(ctx context.Context, purpose string) error {
+	ticker := time.NewTicker(leasePollPeriod)
+	defer ticker.Stop()
+
+	start := time.Now()
+	lastLog := time.Time{}
+	for {
+		acquired, holder, err := l.tryAcquire(ctx)
+		switch {
+		case ctx.Err() != nil:
+			return ctx.Err()
+		case err != nil:
+			log.Printf("Acquiring lease %s: %s", l.name, err)
+		case acquired:
+			return nil
+		case time.Since(lastLog) >= leaseLogPeriod:
+			log.Printf("Waiting for %s held by %s in lease %s since %s", purpose, holder, l.name, time.Since(start).Round(time.Second))
+			lastLog = time.Now()
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// tryAcquire acquires the lease, if it does not exist or has expired, and otherwise returns its holder
+func (l *lease) tryAcquire(ctx context.Context) (bool, string, error) {
+	now := time.Now()
+	existing, err := l.leases.Get(ctx, l.name, metav1.GetOptions{})
+	if k8serrors.IsNotFound(err) {
+		created, err := l.leases.Create(ctx, &coordinationv1.Lease{
+			ObjectMeta: metav1.ObjectMeta{Name: l.name, Labels: l.labels},
+			Spec:       l.spec(now),
+		}, metav1.CreateOptions{})
+		if k8serrors.IsAlreadyExists(err) {
+			return false, "", nil
+		}
+		if err != nil {
+			return false, "", errors.Wrap(err, "creating lease")
+		}
+		l.start(created)
+		return true, l.holder, nil
+	}
+	if err != nil {
+		return false, "", errors.Wrap(err, "getting lease")
+	}
+
+	if holder := getLeaseHolder(existing, now); holder != "" {
+		return false, holder, nil
+	}
+
+	// The lease expired, the update fails with a conflict, if another procedure acquired it in the meantime
+	existing.Spec = l.spec(now)
+	updated, err := l.leases.Update(ctx, existing, metav1.UpdateOptions{})
+	if k8serrors.IsConflict(err) {
+		return false, "", nil
+	}
+	if err != nil {
+		return false, "", errors.Wrap(err, "taking over expired lease")
+	}
+	l.start(updated)
+	return true, l.holder, nil
+}
+
+// context returns a context derived from ctx, which is canceled, when the lease gets lost
+func (l *lease) context(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		select {
+		case <-l.lost:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	return ctx, cancel
+}
+
+// isLost returns true, if the lease got lost while it was held
+func (l *lease) isLost() bool {
+	select {
+	case <-l.lost:
+		return true
+	default:
+		return false
+	}
+}
+
+// release stops renewing the lease and deletes it, so a waiting procedure acquires it immediately
+func (l *lease) release() {
+	if l.cancel == nil {
+		return
+	}
+	l.cancel()
+	<-l.done
+	l.cancel = nil
+
+	// Another procedure may hold the lease now
+	if l.isLost() {
+		return
+	}
+
+	// The preconditions keep the lease, if it was changed after the last renewal, e.g. taken over after it expired.
+	// The context of the procedure may be cancelled already.
+	uid, resourceVersion := l.current.UID, l.current.ResourceVersion
+	opts := metav1.DeleteOptions{Preconditions: &metav1.Preconditions{UID: &uid, ResourceVersion: &resourceVersion}}
+	err := l.leases.Delete(context.Background(), l.name, opts)
+	if err != nil && !k8serrors.IsNotFound(err) && !k8serrors.IsConflict(err) {
+		log.Printf("Releasing lease %s: %s", l.name, err)
+	}
+}
+
+// start renews the acquired lease in the background. The lease is lost, if another procedure took it over
+// or if it could not be renewed in time, so another procedure may take it over.
+func (l *lease) start(acquired *coordinationv1.Lease) {
+	l.current = acquired
+	ctx, cancel := context.WithCancel(context.Background())
+	l.cancel = cancel
+	l.lost = make(chan struct{})
+	l.done = make(chan struct{})
+
+	go func() {
+		defer close(l.done)
+		ticker := time.NewTicker(l.renewPeriod)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+
+			err := l.renew(ctx)
+			if err == nil || ctx.Err() != nil {
+				continue
+			}
+			log.Printf("Renewing lease %s: %s", l.name, err)
+
+			// The lease expires, before the next renewal succeeds
+			if err == errLeaseLost || time.Since(l.current.Spec.RenewTime.Time) >= l.duration-l.renewPeriod {
+				log.Printf("Lost lease %s", l.name)
+				close(l.lost)
+				return
+			}
+		}
+	}()
+}
+
+// renew updates the renew time of the held lease. It returns errLeaseLost, if another procedure holds the lease.
+func (l *lease) renew(ctx context.Context) error {
+	// The lease is checked first, as it may have been taken over by another procedure
+	latest, err := l.leases.Get(ctx, l.name, metav1.GetOptions{})
+	switch {
+	case k8serrors.IsNotFound(err):
+		return errLeaseLost
+	case err != nil:
+		return err
+	case latest.UID != l.current.UID || latest.Spec.HolderIdentity == nil || *latest.Spec.HolderIdentity != l.holder:
+		return errLeaseLost
+	}
+
+	// The update fails with a conflict, if the lease got changed in the meantime
+	latest.Spec.RenewTime = &metav1.MicroTime{Time: time.Now()}
+	renewed, err := l.leases.Update(ctx, latest, metav1.UpdateOptions{})
+	if err != nil {
+		return err
+	}
+	l.current = renewed
+
+	return nil
+}
+
+// spec returns the spec of the lease held by this procedure
+func (l *lease) spec(now time.Time) coordinationv1.LeaseSpec {
+	return coordinationv1.LeaseSpec{
+		HolderIdentity:       &l.holder,
+		LeaseDurationSeconds: Int32Ref(int32(leaseDuration.Seconds())),
+		AcquireTime:          &metav1.MicroTime{Time: now},
+		RenewTime:            &metav1.MicroTime{Time: now},
+	}
+}
+
+// getLeaseHolder returns the holder of the lease or an empty string, if the lease is not held or expired
+func getLeaseHolder(l *coordinationv1.Lease, now time.Time) string {
+	if l.Spec.HolderIdentity == nil || *l.Spec.HolderIdentity == "" || l.Spec.RenewTime == nil {
+		return ""
+	}
+
+	duration := leaseDuration
+	if l.Spec.LeaseDurationSeconds != nil {
+		duration = time.Duration(*l.Spec.LeaseDurationSeconds) * time.Second
+	}
+	if now.After(l.Spec.RenewTime.Add(duration)) {
+		return ""
+	}
+
+	return *l.Spec.HolderIdentity
+}
+
+// acquireBuilderSlot waits until one of the builder.max_concurrent slots is acquired or the context is canceled.
+// The slots are leases in the namespace of the builder pods, so they are shared by all peers using the namespace.
+func acquireBuilderSlot(ctx context.Context, cfg Config, label string) (*lease, error) {
+	names := make([]string, cfg.Builder.MaxConcurrent)
+	for i := range names {
+		names[i] = fmt.Sprintf("k8scc-builder-slot-%d", i)
+	}
+	slots, err := newLeases(cfg, names, map[string]string{
+		"app.kubernetes.io/managed-by": "hlfabric-k8scc",
+		leaseKindLabel:                 leaseKindBuilder,
+	})
+	if err != nil {
+		return nil, err
+	}
+	leases := slots[0].leases
+
+	// Start at a random slot, so the waiting builds do not compete for the same slot
+	offset := rand.New(rand.NewSource(time.Now().UnixNano())).Intn(len(slots)) // #nosec G404
+
+	ticker := time.NewTicker(slotPollPeriod)
+	defer ticker.Stop()
+
+	start := time.Now()
+	lastLog := time.Time{}
+	for {
+		// A single list shows the free slots, only these are acquired
+		list, err := leases.List(ctx, metav1.ListOptions{LabelSelector: leaseKindLabel + "=" + leaseKindBuilder})
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if err != nil {
+			log.Printf("Listing builder slots: %s", err)
+		}
+
+		holders := map[string]string{}
+		if list != nil {
+			now := time.Now()
+			for i := range list.Items {
+				holders[list.Items[i].Name] = getLeaseHolder(&list.Items[i], now)
+			}
+		}
+
+		held := 0
+		for i := range slots {
+			slot := slots[(offset+i)%len(slots)]
+			if holders[slot.name] != "" {
+				held++
+				continue
+			}
+
+			acquired, _, err := slot.tryAcquire(ctx)
+			switch {
+			case ctx.Err() != nil:
+				return nil, ctx.Err()
+			case err != nil:
+				log.Printf("Acquiring builder slot %s: %s", slot.name, err)
+			case acquired:
+				if !lastLog.IsZero() {
+					log.Printf("Build of chaincode %s got builder slot %s after %s", label, slot.name, time.Since(start).Round(time.Second))
+				}
+				return slot, nil
+			}
+		}
+
+		if time.Since(lastLog) >= leaseLogPeriod {
+			log.Printf("Build of chaincode %s is queued since %s, %d of %d builder slots are held",
+				label, time.Since(start).Round(time.Second), held, len(slots))
+			lastLog = time.Now()
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func newTestLease(holder string, renewed time.Time) *coordinationv1.Lease {
+	return &coordinationv1.Lease{
+		ObjectMeta: metav1.ObjectMeta{Name: "k8scc-build-test", Namespace: "fabric"},
+		Spec: coordinationv1.LeaseSpec{
+			HolderIdentity:       &holder,
+			LeaseDurationSeconds: Int32Ref(30),
+			RenewTime:            &metav1.MicroTime{Time: renewed},
+		},
+	}
+}
+
+func TestGetLeaseHolder(t *testing.T) {
+	now := time.Now()
+	empty := ""
+
+	tests := []struct {
+		name  string
+		lease *coordinationv1.Lease
+		want  string
+	}{
+		{name: "held", lease: newTestLease("peer0-1", now.Add(-10*time.Second)), want: "peer0-1"},
+		{name: "expired", lease: newTestLease("peer0-1", now.Add(-31*time.Second)), want: ""},
+		{name: "released", lease: &coordinationv1.Lease{Spec: coordinationv1.LeaseSpec{HolderIdentity: &empty}}, want: ""},
+		{name: "without holder", lease: &coordinationv1.Lease{}, want: ""},
+		{
+			name: "default duration",
+			lease: func() *coordinationv1.Lease {
+				l := newTestLease("peer0-1", now.Add(-20*time.Second))
+				l.Spec.LeaseDurationSeconds = nil
+				return l
+			}(),
+			want: "peer0-1",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := getLeaseHolder(tt.lease, now); got != tt.want {
+				t.Errorf("getLeaseHolder() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTryAcquire(t *testing.T) {
+	now := time.Now()
+
+	tests := []struct {
+		name       string
+		existing   *coordinationv1.Lease
+		wantOK     bool
+		wantHolder string
+	}{
+		{name: "not existing", wantOK: true, wantHolder: "peer0-1"},
+		{name: "held by another build", existing: newTestLease("peer1-7", now), wantOK: false, wantHolder: "peer1-7"},
+		{name: "expired", existing: newTestLease("peer1-7", now.Add(-time.Minute)), wantOK: true, wantHolder: "peer0-1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clientset := fake.NewSimpleClientset()
+			leases := clientset.CoordinationV1().Leases("fabric")
+			if tt.existing != nil {
+				if _, err := leases.Create(context.Background(), tt.existing, metav1.CreateOptions{}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			l := newLeaseWithClient(leases, "k8scc-build-test", "peer0-1", nil)
+			ok, holder, err := l.tryAcquire(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer l.release()
+			if ok != tt.wantOK || holder != tt.wantHolder {
+				t.Errorf("tryAcquire() = %t, %q, want %t, %q", ok, holder, tt.wantOK, tt.wantHolder)
+			}
+
+			stored, err := leases.Get(context.Background(), "k8scc-build-test", metav1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := getLeaseHolder(stored, time.Now()); got != tt.wantHolder {
+				t.Errorf("holder of the stored lease = %q, want %q", got, tt.wantHolder)
+			}
+		})
+	}
+}
+
+func TestLeaseRelease(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+	leases := clientset.CoordinationV1().Leases("fabric")
+
+	l := newLeaseWithClient(leases, "k8scc-build-test", "peer0-1", nil)
+	ok, _, err := l.tryAcquire(context.Background())
+	if err != nil || !ok {
+		t.Fatalf("tryAcquire() = %t, %v", ok, err)
+	}
+	l.release()
+
+	if _, err := leases.Get(context.Background(), "k8scc-build-test", metav1.GetOptions{}); err == nil {
+		t.Error("lease still exists after release")
+	}
+}
+
+func TestLeaseLost(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(leases *coordinationv1.Lease) *coordinationv1.Lease // nil deletes the lease
+	}{
+		{name: "deleted"},
+		{
+			name: "taken over",
+			change: func(l *coordinationv1.Lease) *coordinationv1.Lease {
+				holder := "peer1-7"
+				l.Spec.HolderIdentity = &holder
+				return l
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			clientset := fake.NewSimpleClientset()
+			leases := clientset.CoordinationV1().Leases("fabric")
+
+			l := newLeaseWithClient(leases, "k8scc-build-test", "peer0-1", nil)
+			l.renewPeriod = 10 * time.Millisecond
+			ok, _, err := l.tryAcquire(ctx)
+			if err != nil || !ok {
+				t.Fatalf("tryAcquire() = %t, %v", ok, err)
+			}
+			buildCtx, cancel := l.context(ctx)
+			defer cancel()
+
+			// Another procedure changes the lease
+			stored, err := leases.Get(ctx, l.name, metav1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.change == nil {
+				err = leases.Delete(ctx, l.name, metav1.DeleteOptions{})
+			} else {
+				_, err = leases.Update(ctx, tt.change(stored), metav1.UpdateOptions{})
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			select {
+			case <-buildCtx.Done():
+			case <-time.After(5 * time.Second):
+				t.Fatal("context not canceled after the lease got lost")
+			}
+			if !l.isLost() {
+				t.Error("isLost() = false, want true")
+			}
+
+			// The lease of the other procedure is kept
+			l.release()
+			if tt.change != nil {
+				if _, err := leases.Get(ctx, l.name, metav1.GetOptions{}); err != nil {
+					t.Errorf("lease of the other procedure got deleted: %s", err)
+				}
+			}
+		})
+	}
+}
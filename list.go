@@ -0,0 +1,274 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// allPodsSelector selects all pods created by k8scc including the pods of chaincodes as a service
+const allPodsSelector = "externalcc-type in (builder,launcher,ccaas)"
+
+// PodSummary describes a builder or chaincode pod managed by k8scc
+type PodSummary struct {
+	Name            string    `json:"name" yaml:"name"`
+	Namespace       string    `json:"namespace" yaml:"namespace"`
+	Type            string    `json:"type" yaml:"type"`
+	Peer            string    `json:"peer,omitempty" yaml:"peer,omitempty"`
+	MSPID           string    `json:"mspid,omitempty" yaml:"mspid,omitempty"`
+	Label           string    `json:"chaincode_label,omitempty" yaml:"chaincode_label,omitempty"`
+	CCID            string    `json:"ccid,omitempty" yaml:"ccid,omitempty"`
+	Image           string    `json:"image" yaml:"image"`
+	Phase           string    `json:"phase" yaml:"phase"`
+	Ready           bool      `json:"ready" yaml:"ready"`
+	Restarts        int32     `json:"restarts" yaml:"restarts"`
+	Created         time.Time `json:"created" yaml:"created"`
+	LastTermination string    `json:"last_termination,omitempty" yaml:"last_termination,omitempty"`
+}
+
+// PodStatus is the detailed status of a pod shown by the command status
+type PodStatus struct {
+	PodSummary       `yaml:",inline"`
+	Node             string            `json:"node,omitempty" yaml:"node,omitempty"`
+	Message          string            `json:"message,omitempty" yaml:"message,omitempty"`
+	Containers       []ContainerStatus `json:"containers" yaml:"containers"`
+	LastWarningEvent string            `json:"last_warning_event,omitempty" yaml:"last_warning_event,omitempty"`
+}
+
+// managedPod is a pod managed by k8scc with the configuration to access its namespace and cluster
+type managedPod struct {
+	apiv1.Pod
+	cfg Config
+}
+
+// ContainerStatus is the state of a container of a pod
+type ContainerStatus struct {
+	Name     string `json:"name" yaml:"name"`
+	State    string `json:"state" yaml:"state"`
+	Ready    bool   `json:"ready" yaml:"ready"`
+	Restarts int32  `json:"restarts" yaml:"restarts"`
+}
+
+// List prints the builder and chaincode pods managed by k8scc
+func List(ctx context.Context, cfg Config) error {
+	flags := flag.NewFlagSet("list", flag.ContinueOnError)
+	output := flags.String("o", "table", "output format: table, json or yaml")
+	podType := flags.String("type", "", "only pods of this type: builder, launcher or ccaas")
+	peer := flags.String("peer", "", "only pods of this peer pod")
+	label := flags.String("label", "", "only pods of chaincodes with this label")
+
+	err := flags.Parse(getCommandArgs("list"))
+	if err != nil {
+		return err
+	}
+
+	pods, err := listManagedPods(ctx, cfg)
+	if err != nil {
+		return err
+	}
+
+	summaries := []PodSummary{}
+	for i := range pods {
+		s := getPodSummary(&pods[i].Pod)
+		if (*podType != "" && s.Type != *podType) || (*peer != "" && s.Peer != *peer) || (*label != "" && s.Label != *label) {
+			continue
+		}
+		summaries = append(summaries, s)
+	}
+
+	return printOutput(os.Stdout, *output, summaries, func(w io.Writer) {
+		fmt.Fprintln(w, "NAME\tNAMESPACE\tTYPE\tPEER\tCHAINCODE\tIMAGE\tPHASE\tREADY\tRESTARTS\tAGE\tLAST TERMINATION")
+		for _, s := range summaries {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%t\t%d\t%s\t%s\n", s.Name, s.Namespace, s.Type, s.Peer, s.Label, s.Image,
+				s.Phase, s.Ready, s.Restarts, time.Since(s.Created).Round(time.Second), s.LastTermination)
+		}
+	})
+}
+
+// Status prints the detailed status of the pods matching the name, the chaincode ID or the chaincode label
+func Status(ctx context.Context, cfg Config) error {
+	flags := flag.NewFlagSet("status", flag.ContinueOnError)
+	output := flags.String("o", "table", "output format: table, json or yaml")
+
+	err := flags.Parse(getCommandArgs("status"))
+	if err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return errors.New("status requires a pod name, chaincode ID or chaincode label as argument")
+	}
+	query := flags.Arg(0)
+
+	pods, err := listManagedPods(ctx, cfg)
+	if err != nil {
+		return err
+	}
+
+	statuses := []PodStatus{}
+	for i := range pods {
+		s := getPodSummary(&pods[i].Pod)
+		if s.Name != query && s.CCID != query && s.Label != query {
+			continue
+		}
+		statuses = append(statuses, getPodStatus(ctx, pods[i].cfg, &pods[i].Pod, s))
+	}
+	if len(statuses) == 0 {
+		return fmt.Errorf("no pod found for %q", query)
+	}
+
+	return printOutput(os.Stdout, *output, statuses, func(w io.Writer) {
+		for i, s := range statuses {
+			if i > 0 {
+				fmt.Fprintln(w)
+			}
+			fmt.Fprintf(w, "Name:\t%s\nNamespace:\t%s\nType:\t%s\nPeer:\t%s\nMSP ID:\t%s\nChaincode:\t%s\nCCID:\t%s\nImage:\t%s\nNode:\t%s\n",
+				s.Name, s.Namespace, s.Type, s.Peer, s.MSPID, s.Label, s.CCID, s.Image, s.Node)
+			fmt.Fprintf(w, "Phase:\t%s\nMessage:\t%s\nReady:\t%t\nRestarts:\t%d\nAge:\t%s\nLast termination:\t%s\nLast warning event:\t%s\n",
+				s.Phase, s.Message, s.Ready, s.Restarts, time.Since(s.Created).Round(time.Second), s.LastTermination, s.LastWarningEvent)
+			for _, c := range s.Containers {
+				fmt.Fprintf(w, "Container %s:\t%s, ready %t, restarts %d\n", c.Name, c.State, c.Ready, c.Restarts)
+			}
+		}
+	})
+}
+
+// listManagedPods returns the pods created by k8scc in the namespaces of the peer, the builder and the chaincodes
+// sorted by name
+func listManagedPods(ctx context.Context, cfg Config) ([]managedPod, error) {
+	targets, err := cfg.getTargets()
+	if err != nil {
+		return nil, errors.Wrap(err, "getting namespaces of pods")
+	}
+
+	managed := []managedPod{}
+	for _, target := range targets {
+		clientset, err := getKubernetesClientset(target)
+		if err != nil {
+			return nil, errors.Wrap(err, "getting kubernetes clientset")
+		}
+
+		pods, err := clientset.CoreV1().Pods(target.Namespace).List(ctx, metav1.ListOptions{LabelSelector: allPodsSelector})
+		if err != nil {
+			return nil, errors.Wrapf(err, "listing pods in namespace %s", target.Namespace)
+		}
+		for i := range pods.Items {
+			managed = append(managed, managedPod{Pod: pods.Items[i], cfg: target})
+		}
+	}
+
+	sort.Slice(managed, func(i, j int) bool {
+		return managed[i].Name < managed[j].Name
+	})
+
+	return managed, nil
+}
+
+// getPodSummary describes the pod using the labels and annotations set by k8scc
+func getPodSummary(p *apiv1.Pod) PodSummary {
+	s := PodSummary{
+		Name:      p.Name,
+		Namespace: p.Namespace,
+		Type:      p.Labels["externalcc-type"],
+		Peer:      p.Labels[metadataPrefix+"peer"],
+		MSPID:     p.Labels[metadataPrefix+"mspid"],
+		Label:     p.Labels[metadataPrefix+"chaincode-label"],
+		CCID:      p.Annotations[metadataPrefix+"ccid"],
+		Phase:     string(p.Status.Phase),
+		Ready:     isPodReady(p),
+		Created:   p.CreationTimestamp.Time,
+	}
+
+	// Pods created by older versions are only linked to the peer by the owner reference
+	if s.Peer == "" {
+		for _, ref := range p.OwnerReferences {
+			if ref.Kind == "Pod" {
+				s.Peer = ref.Name
+			}
+		}
+	}
+
+	if len(p.Spec.Containers) > 0 {
+		s.Image = p.Spec.Containers[0].Image
+	}
+
+	var lastFinished time.Time
+	statuses := append(p.Status.InitContainerStatuses, p.Status.ContainerStatuses...) // nolint:gocritic
+	for _, c := range statuses {
+		s.Restarts += c.RestartCount
+		for _, t := range []*apiv1.ContainerStateTerminated{c.State.Terminated, c.LastTerminationState.Terminated} {
+			if t != nil && t.FinishedAt.After(lastFinished) {
+				lastFinished = t.FinishedAt.Time
+				s.LastTermination = fmt.Sprintf("%s: %s, exit code %d", c.Name, t.Reason, t.ExitCode)
+			}
+		}
+	}
+
+	return s
+}
+
+// getPodStatus adds the state of the containers and the last warning event to the summary
+func getPodStatus(ctx context.Context, cfg Config, p *apiv1.Pod, summary PodSummary) PodStatus {
+	s := PodStatus{
+		PodSummary:       summary,
+		Node:             p.Spec.NodeName,
+		Message:          p.Status.Message,
+		Containers:       []ContainerStatus{},
+		LastWarningEvent: getLastWarningEvent(ctx, cfg, p),
+	}
+
+	statuses := append(p.Status.InitContainerStatuses, p.Status.ContainerStatuses...) // nolint:gocritic
+	for _, c := range statuses {
+		state := "unknown"
+		switch {
+		case c.State.Waiting != nil:
+			state = "waiting: " + c.State.Waiting.Reason
+		case c.State.Running != nil:
+			state = "running since " + c.State.Running.StartedAt.Format(time.RFC3339)
+		case c.State.Terminated != nil:
+			state = fmt.Sprintf("terminated: %s, exit code %d", c.State.Terminated.Reason, c.State.Terminated.ExitCode)
+		}
+
+		s.Containers = append(s.Containers, ContainerStatus{
+			Name:     c.Name,
+			State:    state,
+			Ready:    c.Ready,
+			Restarts: c.RestartCount,
+		})
+	}
+
+	return s
+}
+
+// printOutput prints the value as JSON or YAML, or as table using the printTable function
+func printOutput(w io.Writer, format string, v interface{}, printTable func(w io.Writer)) error {
+	switch format {
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	case "yaml":
+		data, err := yaml.Marshal(v)
+		if err != nil {
+			return errors.Wrap(err, "marshaling output")
+		}
+		_, err = w.Write(data)
+		return err
+	case "table", "":
+		tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+		printTable(tw)
+		return tw.Flush()
+	default:
+		return fmt.Errorf("unknown output format %q", format)
+	}
+}
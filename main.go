@@ -11,21 +11,25 @@ import (
 	"os"
 	"os/signal"
 	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
 	"syscall"
-
-	"gopkg.in/yaml.v2"
+	"time"
 
 	"github.com/pkg/errors"
 	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
-	"k8s.io/client-go/rest"
-	"k8s.io/client-go/tools/cache"
 )
 
 const (
-	namespaceFile = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+	namespaceFile   = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+	logDrainTimeout = 10 * time.Second
+
+	defaultLogTailLines = 50
+	defaultLogTailBytes = 4096
 )
 
 // Procedure implements a Hyperledger Fabric externalbuilders command
@@ -38,37 +42,38 @@ func main() {
 		"build":   Build,
 		"release": Release,
 		"run":     Run,
+		"gc":      GC,
+		"list":    List,
+		"status":  Status,
+		"render":  Render,
+		"doctor":  Doctor,
+
+		"validate-config": ValidateConfig,
 	}
 
-	proc := getProcedureFromArg(procedures)
+	name, proc := getProcedureFromArg(procedures)
 	if proc == nil {
 		log.Fatalln("Please pass one of the following values as first argument" +
-			"or set it as the name of the executable: detect, build, release, run")
-	}
-
-	// Read configuration
-	cfgFile := os.Getenv("K8SCC_CFGFILE")
-	if cfgFile == "" {
-		cfgFile = "/opt/k8scc/k8scc.yaml"
+			"or set it as the name of the executable: detect, build, release, run, gc, list, status, render, doctor, validate-config")
 	}
 
-	cfgData, err := ioutil.ReadFile(cfgFile)
-	if err != nil {
+	// Read configuration, the command validate-config reports the problems itself
+	cfgFile := getConfigFile()
+	cfg, err := loadConfig(cfgFile)
+	if err != nil && name != "validate-config" {
 		log.Fatalf("Loading configuration file %s: %s", cfgFile, err)
 	}
 
-	cfg := Config{}
-	err = yaml.Unmarshal(cfgData, &cfg)
-	if err != nil {
-		log.Fatalf("Parsing configuration: %s", err)
-	}
-
-	// Read namespace
-	namespace, err := ioutil.ReadFile(namespaceFile)
-	if err != nil {
-		log.Fatalf("Reading namespace file %s: %s", namespaceFile, err)
+	// Get namespace, it is not available outside of Kubernetes without configuration.
+	// The commands render, doctor and validate-config do not require it.
+	cfg.Kubernetes = cfg.Kubernetes.WithEnv()
+	cfg.Namespace, err = getNamespace(cfg.Kubernetes)
+	optional := name == "render" || name == "doctor" || name == "validate-config"
+	if err != nil && !(optional && errors.Cause(err) == errNoNamespace) {
+		log.Fatalln(err)
 	}
-	cfg.Namespace = string(namespace)
+	cfg.PeerNamespace = cfg.Namespace
+	cfg.PeerKubernetes = cfg.Kubernetes
 
 	// Handle SIGTERM and SIGINT in order to collect garbage.
 	// We cancel the request/procedure using a context, so we can cancel it.
@@ -89,15 +94,28 @@ func main() {
 	}
 }
 
-func getProcedureFromArg(procs map[string]Procedure) Procedure {
+func getProcedureFromArg(procs map[string]Procedure) (string, Procedure) {
 	for argi := 0; argi < len(os.Args) && argi < 2; argi++ {
 		function := filepath.Base(os.Args[argi])
 		proc, ok := procs[function]
 		if ok {
-			return proc
+			return function, proc
 		}
 	}
 
+	return "", nil
+}
+
+// getCommandArgs returns the arguments following the name of the command,
+// which is passed as first argument or set as the name of the executable
+func getCommandArgs(name string) []string {
+	if filepath.Base(os.Args[0]) == name {
+		return os.Args[1:]
+	}
+	if len(os.Args) > 1 && filepath.Base(os.Args[1]) == name {
+		return os.Args[2:]
+	}
+
 	return nil
 }
 
@@ -108,38 +126,127 @@ type Config struct {
 		Path  string `yaml:"path"`
 		Claim string `yaml:"claim"`
 	} `yaml:"transfer_volume"`
+	Transfer struct {
+		Mode  string `yaml:"mode"`  // pv (default) or exec
+		Image string `yaml:"image"` // image of the transfer init container, defaults to the image of the pod
+	} `yaml:"transfer"`
 
 	Builder struct {
-		Resources struct {
-			LimitMemory string `yaml:"memory_limit"`
-			LimitCPU    string `yaml:"cpu_limit"`
-		} `yaml:"resources"`
+		PodConfig     `yaml:",inline"`
+		TargetConfig  `yaml:",inline"`
+		NameTemplate  string    `yaml:"name_template"`  // Go template of the pod name
+		Kind          string    `yaml:"kind"`           // pod (default) or job
+		MaxConcurrent int       `yaml:"max_concurrent"` // builder pods in the namespace of all peers, unlimited if 0
+		Job           JobConfig `yaml:"job"`
+		Cache         struct {
+			Enabled    bool   `yaml:"enabled"`
+			Path       string `yaml:"path"`     // defaults to cache/ on the transfer volume
+			MaxSize    string `yaml:"max_size"` // e.g. 5Gi, unlimited if empty
+			MaxEntries int    `yaml:"max_entries"`
+		} `yaml:"cache"`
 	} `yaml:"builder"`
 
 	Launcher struct {
-		Resources struct {
-			LimitMemory string `yaml:"memory_limit"`
-			LimitCPU    string `yaml:"cpu_limit"`
-		} `yaml:"resources"`
+		PodConfig    `yaml:",inline"`
+		TargetConfig `yaml:",inline"`
+		NameTemplate string      `yaml:"name_template"` // Go template of the pod or deployment name
+		Mode         string      `yaml:"mode"`          // pod (default) or ccaas
+		Artifacts    string      `yaml:"artifacts"`     // transfer (default) or secret
+		CCaaS        CCaaSConfig `yaml:"ccaas"`
 	} `yaml:"launcher"`
 
+	Overrides []Override `yaml:"overrides"` // per chaincode configuration
+
+	Kubernetes KubernetesConfig `yaml:"kubernetes"` // connection to Kubernetes, in-cluster by default
+
+	LogTail struct {
+		Lines int `yaml:"lines"` // number of log lines added to errors
+		Bytes int `yaml:"bytes"` // maximum size of log lines added to errors
+	} `yaml:"log_tail"`
+
+	Timeouts struct {
+		Unschedulable       time.Duration  `yaml:"unschedulable"`         // fail, if a pod cannot be scheduled for this duration
+		Pending             time.Duration  `yaml:"pending"`               // fail, if a pod is pending for this duration
+		Build               time.Duration  `yaml:"build"`                 // fail, if a build takes longer
+		Startup             time.Duration  `yaml:"startup"`               // fail, if a chaincode is not ready after this duration
+		DeletionGracePeriod *time.Duration `yaml:"deletion_grace_period"` // grace period for deleting pods
+	} `yaml:"timeouts"`
+
 	// Internal configurations
-	Namespace string `yaml:"-"`
+	Namespace      string           `yaml:"-"` // namespace of the created objects
+	PeerNamespace  string           `yaml:"-"` // namespace of the peer pod
+	PeerKubernetes KubernetesConfig `yaml:"-"` // connection to the cluster of the peer pod
+}
+
+// PodConfig defines the configuration of the builder or chaincode pods, which can be overridden per chaincode
+type PodConfig struct {
+	Resources   Resources         `yaml:"resources"`
+	Env         map[string]string `yaml:"env"`         // additional environment variables
+	Labels      map[string]string `yaml:"labels"`      // additional labels
+	Annotations map[string]string `yaml:"annotations"` // additional annotations
+	PodTemplate PodTemplate       `yaml:"pod_template"`
+}
+
+// Resources defines the resource limits of a pod
+type Resources struct {
+	LimitMemory string `yaml:"memory_limit"`
+	LimitCPU    string `yaml:"cpu_limit"`
+}
+
+// Limits returns the resource limits for a container
+func (r Resources) Limits() (apiv1.ResourceList, error) {
+	limits := apiv1.ResourceList{}
+	if limit := r.LimitMemory; limit != "" {
+		q, err := resource.ParseQuantity(limit)
+		if err != nil {
+			return nil, errors.Wrapf(err, "parsing memory limit %q", limit)
+		}
+		limits["memory"] = q
+	}
+	if limit := r.LimitCPU; limit != "" {
+		q, err := resource.ParseQuantity(limit)
+		if err != nil {
+			return nil, errors.Wrapf(err, "parsing cpu limit %q", limit)
+		}
+		limits["cpu"] = q
+	}
+
+	return limits, nil
+}
+
+// EnvVars returns the additional environment variables sorted by name
+func (p PodConfig) EnvVars() []apiv1.EnvVar {
+	names := make([]string, 0, len(p.Env))
+	for name := range p.Env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	envvars := make([]apiv1.EnvVar, 0, len(names))
+	for _, name := range names {
+		envvars = append(envvars, apiv1.EnvVar{Name: name, Value: p.Env[name]})
+	}
+
+	return envvars
 }
 
 // BuildInformation is used to serialize build data for consumption by the launcher
 type BuildInformation struct {
-	Image    string
-	Platform string
+	Image      string
+	Platform   string
+	SourceHash string
 }
 
 // ChaincodeMetadata is based on
 // https://github.com/hyperledger/fabric/blob/v2.2.1/core/chaincode/persistence/chaincode_package.go#L229
 type ChaincodeMetadata struct {
-	Type       string `json:"type"` // golang, java, node
-	Path       string `json:"path"`
-	Label      string `json:"label"`
-	MetadataID string
+	Type        string `json:"type"` // golang, java, node
+	Path        string `json:"path"`
+	Label       string `json:"label"`
+	MetadataID  string
+	CCID        string // empty, if the build context does not contain the chaincode ID
+	SourceHash  string
+	PackageHash string // hash of the whole package, which identifies the build
 }
 
 // ChaincodeRunConfig is based on
@@ -153,19 +260,22 @@ type ChaincodeRunConfig struct {
 	MSPID       string `json:"mspid"`
 
 	// Custom fields
-	ShortName string
-	Image     string
-	Platform  string
+	Image      string
+	Platform   string
+	SourceHash string
 }
 
-func streamPodLogs(ctx context.Context, pod *apiv1.Pod) error {
+func streamPodLogs(ctx context.Context, cfg Config, pod *apiv1.Pod, tail *logTail) error {
 	// Setup kubernetes client
-	clientset, err := getKubernetesClientset()
+	clientset, err := getKubernetesClientset(cfg)
 	if err != nil {
 		return errors.Wrap(err, "getting kubernetes clientset")
 	}
 
-	req := clientset.CoreV1().Pods(pod.Namespace).GetLogs(pod.Name, &apiv1.PodLogOptions{Follow: true})
+	req := clientset.CoreV1().Pods(pod.Namespace).GetLogs(pod.Name, &apiv1.PodLogOptions{
+		Container: pod.Spec.Containers[0].Name,
+		Follow:    true,
+	})
 	logs, err := req.Stream(ctx)
 	if err != nil {
 		return errors.Wrap(err, "opening log stream")
@@ -177,6 +287,7 @@ func streamPodLogs(ctx context.Context, pod *apiv1.Pod) error {
 	s := bufio.NewScanner(logs)
 	for s.Scan() {
 		log.Printf("%s: %s", pod.Name, s.Text())
+		tail.add(s.Text())
 	}
 
 	if err := s.Err(); err != nil {
@@ -189,89 +300,223 @@ func streamPodLogs(ctx context.Context, pod *apiv1.Pod) error {
 	return nil
 }
 
-func cleanupPodSilent(pod *apiv1.Pod) {
-	err := cleanupPod(pod)
+func cleanupPodSilent(cfg Config, pod *apiv1.Pod) {
+	err := cleanupPod(cfg, pod)
 	log.Println(err)
 }
 
-func cleanupPod(pod *apiv1.Pod) error {
-	clientset, err := getKubernetesClientset()
+func cleanupPod(cfg Config, pod *apiv1.Pod) error {
+	clientset, err := getKubernetesClientset(cfg)
 	if err != nil {
 		return errors.Wrap(err, "getting kubernetes clientset")
 	}
 
+	return deletePod(clientset, cfg, pod)
+}
+
+// deletePod deletes the pod with the configured grace period
+func deletePod(clientset kubernetes.Interface, cfg Config, pod *apiv1.Pod) error {
+	// The context of the procedure may be cancelled already
 	ctx := context.Background()
-	err = clientset.CoreV1().Pods(pod.Namespace).Delete(ctx, pod.Name, metav1.DeleteOptions{})
-	return err
+	opts := metav1.DeleteOptions{}
+	if grace := cfg.Timeouts.DeletionGracePeriod; grace != nil {
+		opts.GracePeriodSeconds = Int64Ref(int64(grace.Seconds()))
+	}
+
+	return clientset.CoreV1().Pods(pod.Namespace).Delete(ctx, pod.Name, opts)
+}
+
+// podLogAttacher streams the logs of a pod as soon as its container runs.
+// A new stream is attached for every container restart.
+type podLogAttacher struct {
+	ctx      context.Context
+	cancel   context.CancelFunc
+	cfg      Config
+	pod      *apiv1.Pod
+	mutex    sync.Mutex
+	attached map[int32]bool // restart counts with an attached log stream
+	wg       sync.WaitGroup
+	tail     *logTail
+}
+
+func newPodLogAttacher(ctx context.Context, cfg Config, pod *apiv1.Pod) *podLogAttacher {
+	ctx, cancel := context.WithCancel(ctx)
+	return &podLogAttacher{
+		ctx:      ctx,
+		cancel:   cancel,
+		cfg:      cfg,
+		pod:      pod,
+		attached: map[int32]bool{},
+		tail:     newLogTail(cfg.LogTail.Lines, cfg.LogTail.Bytes),
+	}
+}
+
+// update attaches the log stream, if the container of the pod is running or has terminated
+// and no stream is attached for the current container instance yet.
+func (a *podLogAttacher) update(p *apiv1.Pod) {
+	if len(p.Status.ContainerStatuses) == 0 {
+		return
+	}
+
+	status := p.Status.ContainerStatuses[0]
+	if status.State.Running == nil && status.State.Terminated == nil {
+		return // Container has not been started yet
+	}
+
+	a.attach(status.RestartCount)
 }
 
-func watchPodUntilCompletion(ctx context.Context, pod *apiv1.Pod) (bool, error) {
+func (a *podLogAttacher) attach(restartCount int32) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if a.attached[restartCount] {
+		return
+	}
+	a.attached[restartCount] = true
+
+	a.wg.Add(1)
+	go func() {
+		defer a.wg.Done()
+
+		err := streamPodLogs(a.ctx, a.cfg, a.pod, a.tail)
+		if err != nil {
+			log.Printf("While streaming pod logs: %q", err)
+		}
+	}()
+}
+
+// wait blocks until all attached log streams have ended. Streams of containers,
+// which are still running, are stopped after the timeout.
+func (a *podLogAttacher) wait(timeout time.Duration) {
+	done := make(chan struct{})
+	go func() {
+		a.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		a.cancel()
+		<-done
+	}
+
+	a.cancel()
+}
+
+// logTail keeps the last lines of a log, limited by number of lines and bytes
+type logTail struct {
+	mutex    sync.Mutex
+	maxLines int
+	maxBytes int
+	lines    []string
+	size     int
+}
+
+func newLogTail(maxLines, maxBytes int) *logTail {
+	if maxLines == 0 {
+		maxLines = defaultLogTailLines
+	}
+	if maxBytes == 0 {
+		maxBytes = defaultLogTailBytes
+	}
+
+	return &logTail{
+		maxLines: maxLines,
+		maxBytes: maxBytes,
+	}
+}
+
+func (t *logTail) add(line string) {
+	if t == nil {
+		return
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if len(line) > t.maxBytes {
+		line = line[len(line)-t.maxBytes:]
+	}
+
+	t.lines = append(t.lines, line)
+	t.size += len(line) + 1
+	for len(t.lines) > t.maxLines || t.size > t.maxBytes {
+		t.size -= len(t.lines[0]) + 1
+		t.lines = t.lines[1:]
+	}
+}
+
+func (t *logTail) String() string {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	return strings.Join(t.lines, "\n")
+}
+
+// watchPodUntilCompletion watches the pod until it terminates. It returns nil, if the pod succeeded,
+// and an error describing the reason otherwise. Pods, which will not recover, fail early.
+func watchPodUntilCompletion(ctx context.Context, cfg Config, pod *apiv1.Pod) error {
 	// Setup kubernetes client
-	clientset, err := getKubernetesClientset()
+	clientset, err := getKubernetesClientset(cfg)
 	if err != nil {
-		return false, errors.Wrap(err, "getting kubernetes clientset")
-	}
-
-	/* Create log attacher
-	var attachOnce sync.Once
-	attachLogs := func() {
-		go func() {
-			err := streamPodLogs(pod)
-			if err != nil {
-				log.Printf("While streaming pod logs: %q", err)
-			}
-		}()
-	}*/
-
-	// Create informer
-	factory := informers.NewSharedInformerFactoryWithOptions(clientset, 0, informers.WithNamespace(pod.Namespace))
-	informer := factory.Core().V1().Pods().Informer()
-	c := make(chan struct{})
-	defer close(c)
-
-	podSuccessfull := make(chan bool)
-	defer close(podSuccessfull)
-	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
-		UpdateFunc: func(oldPod, newPod interface{}) {
-			p := newPod.(*apiv1.Pod)
-			if p.Name == pod.Name {
-				log.Printf("Received update on pod %s, phase %s", p.Name, p.Status.Phase)
-				// TODO: Can we miss an update, so not getting logs?
-
-				switch p.Status.Phase {
-				case apiv1.PodSucceeded:
-					podSuccessfull <- true
-				case apiv1.PodFailed, apiv1.PodUnknown:
-					podSuccessfull <- false
-				case apiv1.PodPending, apiv1.PodRunning:
-					// Do nothing as this state is good
-				default:
-					podSuccessfull <- false // Unknown phase
-				}
-			}
-		},
-		DeleteFunc: func(oldPod interface{}) {
-			p := oldPod.(*apiv1.Pod)
-			if p.Name == pod.Name {
-				log.Printf("Pod %s, phase %s got deleted", p.Name, p.Status.Phase)
-				podSuccessfull <- false
-			}
-		},
+		return errors.Wrap(err, "getting kubernetes clientset")
+	}
+
+	// Create log attacher
+	logs := newPodLogAttacher(ctx, cfg, pod)
+
+	// Watch the pod until it terminates or will not recover
+	wasReady := false
+	watcher := newPodWatcher(clientset.CoreV1().Pods(pod.Namespace), pod.Name, func(p *apiv1.Pod) (bool, error) {
+		// Attach logs as soon as the container is running
+		logs.update(p)
+
+		// Fail early, if the pod will not recover
+		if err := getFatalPodState(p, cfg.Timeouts.Unschedulable); err != nil {
+			return true, err
+		}
+
+		if isPodReady(p) {
+			wasReady = true
+		}
+		if err := getPodTimeout(cfg, p, wasReady); err != nil {
+			return true, err
+		}
+
+		switch p.Status.Phase {
+		case apiv1.PodSucceeded:
+			return true, nil
+		case apiv1.PodFailed, apiv1.PodUnknown:
+			return true, errors.New(describePodFailure(p))
+		case apiv1.PodPending, apiv1.PodRunning:
+			// Do nothing as this state is good
+			return false, nil
+		default:
+			return true, fmt.Errorf("unknown phase %s", p.Status.Phase)
+		}
 	})
-	go informer.Run(c)
 
-	// Wait for result of informer and stop it afterwards.
-	res := <-podSuccessfull
-	c <- struct{}{}
+	res := watcher.run(ctx)
+	if ctx.Err() != nil {
+		log.Printf("Stop watching pod %s: %s", pod.Name, ctx.Err())
+	}
 
-	// Stream logs
-	// TODO: This should be done as soon as the pod is running or has an result
-	err = streamPodLogs(ctx, pod)
-	if err != nil {
-		log.Printf("While streaming pod logs: %q", err)
+	// Wait until the log streams have received all output of the terminated pod
+	logs.wait(logDrainTimeout)
+
+	// Add the reason reported by Kubernetes and the last lines of the log
+	if res != nil {
+		if event := getLastWarningEvent(ctx, cfg, pod); event != "" {
+			res = fmt.Errorf("%s (last warning event: %s)", res, event)
+		}
+		if tail := logs.tail.String(); tail != "" {
+			res = fmt.Errorf("%s\nlast lines of log:\n%s", res, tail)
+		}
 	}
 
-	return res, nil
+	return res
 }
 
 func getMetadata(metadataDir string) (*ChaincodeMetadata, error) {
@@ -294,7 +539,7 @@ func getMetadata(metadataDir string) (*ChaincodeMetadata, error) {
 		return nil, errors.Wrap(err, "hashing metadata")
 	}
 
-	metadata.MetadataID = fmt.Sprintf("%x", h.Sum(nil))[0:8]
+	metadata.MetadataID = fmt.Sprintf("%x", h.Sum(nil))
 
 	return &metadata, nil
 }
@@ -304,13 +549,48 @@ func BoolRef(b bool) *bool {
 	return &b
 }
 
-func getKubernetesClientset() (*kubernetes.Clientset, error) {
-	// Setup kubernetes client
-	config, err := rest.InClusterConfig()
+// Int32Ref returns the reference to an int32
+func Int32Ref(i int32) *int32 {
+	return &i
+}
+
+// Int64Ref returns the reference to an int64
+func Int64Ref(i int64) *int64 {
+	return &i
+}
+
+// getPeerPod returns the pod of the peer, which runs this process. If the peer does not run
+// in a pod, the returned pod only has the host name of the peer and owns no objects.
+func getPeerPod(ctx context.Context, cfg Config) (*apiv1.Pod, error) {
+	myself, _ := os.Hostname()
+	cfg = cfg.forPeer()
+	if !cfg.Kubernetes.IsPeerPod() {
+		return &apiv1.Pod{ObjectMeta: metav1.ObjectMeta{Name: myself, Namespace: cfg.Namespace}}, nil
+	}
+
+	// The peer may run in another namespace or cluster than the builder and chaincode pods
+	clientset, err := getKubernetesClientset(cfg)
 	if err != nil {
-		return nil, errors.Wrap(err, "getting kubernetes in-cluster config")
+		return nil, errors.Wrap(err, "getting kubernetes clientset")
 	}
 
-	clientset, err := kubernetes.NewForConfig(config)
-	return clientset, errors.Wrap(err, "creating kubernetes client")
+	return clientset.CoreV1().Pods(cfg.Namespace).Get(ctx, myself, metav1.GetOptions{})
+}
+
+// getOwnerReferences returns the references to the owner pod, so an object is deleted together with the pod.
+// Pods, which do not exist in Kubernetes, e.g. a peer running outside of Kubernetes, own no objects.
+func getOwnerReferences(owner *apiv1.Pod) []metav1.OwnerReference {
+	if owner.UID == "" {
+		return nil
+	}
+
+	return []metav1.OwnerReference{
+		{
+			APIVersion:         "v1",
+			Kind:               "Pod",
+			Name:               owner.Name,
+			UID:                owner.UID,
+			BlockOwnerDeletion: BoolRef(true),
+		},
+	}
 }
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"regexp"
+	"strings"
+	"text/template"
+
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+const (
+	defaultBuilderNameTemplate  = "{{.Peer}}-ccbuild-{{.Hash}}"
+	defaultLauncherNameTemplate = "{{.Peer}}-cc-{{.Label}}-{{.Hash}}"
+
+	nameHashLength = 8
+)
+
+// invalidNameChars matches all characters, which are not allowed in a DNS-1123 label
+var invalidNameChars = regexp.MustCompile(`[^a-z0-9-]`) // nolint:gochecknoglobals
+
+// PodNameData are the values available in the name templates of the builder and chaincode pods
+type PodNameData struct {
+	Peer  string // name of the peer pod
+	Label string // label of the chaincode
+	Hash  string // short hash of the chaincode package
+	MSPID string // MSP ID of the peer
+}
+
+// getBuilderPodName returns the name of the builder pod
+func getBuilderPodName(cfg Config, peer string, metadata *ChaincodeMetadata) (string, error) {
+	if len(metadata.PackageHash) < 2*nameHashLength {
+		return "", errors.New("Hash of chaincode package too short")
+	}
+
+	return renderPodName(cfg.Builder.NameTemplate, defaultBuilderNameTemplate, PodNameData{
+		Peer:  peer,
+		Label: metadata.Label,
+		Hash:  metadata.PackageHash[:nameHashLength],
+		MSPID: getPeerMSPID(),
+	})
+}
+
+// getBuildLeaseName returns the name of the Lease, which coordinates the builds of the package
+func getBuildLeaseName(metadata *ChaincodeMetadata) string {
+	return "k8scc-build-" + metadata.PackageHash[:2*nameHashLength]
+}
+
+// getLauncherPodName returns the name of the chaincode pod or deployment
+func getLauncherPodName(cfg Config, peer, ccid, mspid string) (string, error) {
+	parts := strings.SplitN(ccid, ":", 2)
+	if len(parts) != 2 {
+		return "", errors.New("Cannot parse chaincode name")
+	}
+	if len(parts[1]) < nameHashLength {
+		return "", errors.New("Hash of chaincode ID too short")
+	}
+
+	return renderPodName(cfg.Launcher.NameTemplate, defaultLauncherNameTemplate, PodNameData{
+		Peer:  peer,
+		Label: parts[0],
+		Hash:  parts[1][:nameHashLength],
+		MSPID: mspid,
+	})
+}
+
+// renderPodName executes the name template and converts the result into a valid pod name
+func renderPodName(text, defaultText string, data PodNameData) (string, error) {
+	if text == "" {
+		text = defaultText
+	}
+
+	tmpl, err := template.New("name").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", errors.Wrapf(err, "parsing name template %q", text)
+	}
+
+	name := strings.Builder{}
+	err = tmpl.Execute(&name, data)
+	if err != nil {
+		return "", errors.Wrapf(err, "executing name template %q", text)
+	}
+
+	sanitized := sanitizeName(name.String())
+	if errs := validation.IsDNS1123Label(sanitized); len(errs) > 0 {
+		return "", fmt.Errorf("name template %q results in the invalid name %q: %s", text, sanitized, strings.Join(errs, ", "))
+	}
+
+	return sanitized, nil
+}
+
+// sanitizeName converts the name into a DNS-1123 label. Names, which are too long, are truncated
+// and get a hash of the full name as suffix, so they stay unique and deterministic.
+func sanitizeName(name string) string {
+	sanitized := invalidNameChars.ReplaceAllString(strings.ToLower(name), "-")
+	sanitized = strings.Trim(sanitized, "-")
+
+	return truncateWithHash(sanitized, name, validation.DNS1123LabelMaxLength, "-")
+}
+
+// truncateWithHash truncates the sanitized value to max characters with a hash of the original value as suffix
+func truncateWithHash(sanitized, original string, max int, trim string) string {
+	if len(sanitized) <= max {
+		return sanitized
+	}
+
+	hash := fmt.Sprintf("%x", sha256.Sum256([]byte(original)))[:nameHashLength]
+	prefix := strings.TrimRight(sanitized[:max-nameHashLength-1], trim)
+
+	return prefix + "-" + hash
+}
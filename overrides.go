@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// Override replaces the configuration for chaincodes matching the label and MSP ID
+type Override struct {
+	Label string `yaml:"label"` // regular expression matching the whole chaincode label
+	MSPID string `yaml:"mspid"` // MSP ID of the peer, matches all MSPs if empty
+
+	labelRegexp *regexp.Regexp // compiled label expression, set by Config.Validate
+
+	Images   map[string]string `yaml:"images"` // map[technology]image
+	Builder  PodConfig         `yaml:"builder"`
+	Launcher PodConfig         `yaml:"launcher"`
+}
+
+// Matches returns true, if the override applies to the chaincode
+func (o *Override) Matches(label, mspid string) (bool, error) {
+	if o.MSPID != "" && o.MSPID != mspid {
+		return false, nil
+	}
+
+	if o.labelRegexp == nil {
+		err := o.compile()
+		if err != nil {
+			return false, fmt.Errorf("invalid label expression %q in override: %s", o.Label, err)
+		}
+	}
+
+	return o.labelRegexp.MatchString(label), nil
+}
+
+// compile compiles the label expression anchored to match the whole chaincode label
+func (o *Override) compile() error {
+	re, err := regexp.Compile(`^(?:` + o.Label + `)$`)
+	if err != nil {
+		return err
+	}
+	o.labelRegexp = re
+
+	return nil
+}
+
+// ForChaincode returns the configuration with all matching overrides applied in their order
+func (cfg Config) ForChaincode(label, mspid string) (Config, error) {
+	for i := range cfg.Overrides {
+		o := &cfg.Overrides[i]
+		match, err := o.Matches(label, mspid)
+		if err != nil {
+			return cfg, err
+		}
+		if !match {
+			continue
+		}
+
+		images := make(map[string]string, len(cfg.Images)+len(o.Images))
+		for platform, image := range cfg.Images {
+			images[platform] = image
+		}
+		for platform, image := range o.Images {
+			images[platform] = image
+		}
+		cfg.Images = images
+
+		cfg.Builder.PodConfig = cfg.Builder.PodConfig.merge(o.Builder)
+		cfg.Launcher.PodConfig = cfg.Launcher.PodConfig.merge(o.Launcher)
+	}
+
+	return cfg, nil
+}
+
+// merge returns the pod configuration with the values of the override
+func (p PodConfig) merge(o PodConfig) PodConfig {
+	if o.Resources.LimitMemory != "" {
+		p.Resources.LimitMemory = o.Resources.LimitMemory
+	}
+	if o.Resources.LimitCPU != "" {
+		p.Resources.LimitCPU = o.Resources.LimitCPU
+	}
+
+	p.Env = mergeMaps(p.Env, o.Env)
+	p.Labels = mergeMaps(p.Labels, o.Labels)
+	p.Annotations = mergeMaps(p.Annotations, o.Annotations)
+
+	if len(o.PodTemplate) > 0 {
+		p.PodTemplate = o.PodTemplate
+	}
+
+	return p
+}
+
+// mergeMaps returns a new map with the values of both maps, the values of o take precedence
+func mergeMaps(m, o map[string]string) map[string]string {
+	merged := make(map[string]string, len(m)+len(o))
+	for key, value := range m {
+		merged[key] = value
+	}
+	for key, value := range o {
+		merged[key] = value
+	}
+
+	return merged
+}
+
+// getChaincodeLabel returns the label of a chaincode ID
+func getChaincodeLabel(ccid string) string {
+	return strings.SplitN(ccid, ":", 2)[0]
+}
+
+// getPeerMSPID returns the MSP ID of the peer, which runs this process
+func getPeerMSPID() string {
+	return os.Getenv("CORE_PEER_LOCALMSPID")
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestOverrideMatches(t *testing.T) {
+	tests := []struct {
+		name     string
+		override Override
+		label    string
+		mspid    string
+		want     bool
+	}{
+		{name: "same label", override: Override{Label: "analytics"}, label: "analytics", want: true},
+		{name: "label with other suffix", override: Override{Label: "analytics"}, label: "analytics_v2", want: false},
+		{name: "label containing the expression", override: Override{Label: "cc"}, label: "mycc", want: false},
+		{name: "prefix expression", override: Override{Label: "analytics.*"}, label: "analytics_v2", want: true},
+		{name: "alternation", override: Override{Label: "audit|analytics"}, label: "analytics", want: true},
+		{name: "alternation with other suffix", override: Override{Label: "audit|analytics"}, label: "audit_v2", want: false},
+		{name: "same MSP ID", override: Override{Label: "mycc", MSPID: "Org1MSP"}, label: "mycc", mspid: "Org1MSP", want: true},
+		{name: "other MSP ID", override: Override{Label: "mycc", MSPID: "Org1MSP"}, label: "mycc", mspid: "Org2MSP", want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.override.Matches(tt.label, tt.mspid)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("Matches(%q, %q) = %t, want %t", tt.label, tt.mspid, got, tt.want)
+			}
+		})
+	}
+}
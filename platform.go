@@ -9,6 +9,15 @@ import (
 	"github.com/hyperledger/fabric/core/container/dockercontroller"
 )
 
+// PlatformK8s is the chaincode type for packages referencing a prebuilt chaincode image
+const PlatformK8s = "k8s"
+
+// IsPrebuiltImage returns true, if the chaincode type references a prebuilt image,
+// which is started by its own entrypoint
+func IsPrebuiltImage(ccType string) bool {
+	return strings.EqualFold(ccType, PlatformK8s)
+}
+
 // GetPlatform returns the chaincode platform as defined by HyperLedger Fabric Peer
 func GetPlatform(ccType string) platforms.Platform {
 	for _, plt := range platforms.SupportedPlatforms {
@@ -57,3 +66,27 @@ func GetCCMountDir(ccType string) string {
 		return "/usr/local/bin"
 	}
 }
+
+// GetServerArgs returns the arguments to start the chaincode as a service (server mode).
+// The chaincode reads the listen address from CHAINCODE_SERVER_ADDRESS and its ID from CHAINCODE_ID.
+func GetServerArgs(ccType string) []string {
+	// platforms are defined as uppercase in protobuf
+	ccType = strings.ToUpper(ccType)
+
+	switch ccType {
+	case pb.ChaincodeSpec_GOLANG.String():
+		return []string{"chaincode"}
+	case pb.ChaincodeSpec_JAVA.String():
+		return []string{"/root/chaincode-java/start"}
+	case pb.ChaincodeSpec_NODE.String():
+		return []string{
+			"/bin/sh", "-c",
+			"cd /usr/local/src; npx fabric-chaincode-node server " +
+				"--chaincode-address=$CHAINCODE_SERVER_ADDRESS --chaincode-id=$CHAINCODE_ID",
+		}
+	default:
+		// Fall back to Go
+		log.Printf("Unknown platform %q for chaincode server args, we will use a default", ccType)
+		return []string{"chaincode"}
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+)
+
+const defaultUnschedulableTimeout = 5 * time.Minute
+
+// fatalWaitingReasons are reasons of waiting containers, which will not recover without user interaction.
+// ErrImagePull may be temporary, it becomes ImagePullBackOff after the first retry.
+var fatalWaitingReasons = map[string]bool{ // nolint:gochecknoglobals
+	"ImagePullBackOff":           true,
+	"InvalidImageName":           true,
+	"ErrImageNeverPull":          true,
+	"CreateContainerConfigError": true,
+	"CreateContainerError":       true,
+}
+
+// getFatalPodState returns an error, if the pod is in a state it will not recover from
+func getFatalPodState(p *apiv1.Pod, unschedulableTimeout time.Duration) error {
+	statuses := append(p.Status.InitContainerStatuses, p.Status.ContainerStatuses...) // nolint:gocritic
+	for _, s := range statuses {
+		if w := s.State.Waiting; w != nil && fatalWaitingReasons[w.Reason] {
+			return fmt.Errorf("container %s cannot be started: %s: %s", s.Name, w.Reason, w.Message)
+		}
+	}
+
+	if unschedulableTimeout == 0 {
+		unschedulableTimeout = defaultUnschedulableTimeout
+	}
+
+	for _, c := range p.Status.Conditions {
+		if c.Type == apiv1.PodScheduled && c.Status == apiv1.ConditionFalse && c.Reason == apiv1.PodReasonUnschedulable &&
+			time.Since(p.CreationTimestamp.Time) > unschedulableTimeout {
+			return fmt.Errorf("pod is unschedulable for more than %s: %s", unschedulableTimeout, c.Message)
+		}
+	}
+
+	return nil
+}
+
+// describePodFailure describes why the containers of a failed pod terminated
+func describePodFailure(p *apiv1.Pod) string {
+	reasons := []string{}
+	if p.Status.Reason != "" {
+		reasons = append(reasons, fmt.Sprintf("pod %s: %s", p.Status.Reason, p.Status.Message))
+	}
+
+	statuses := append(p.Status.InitContainerStatuses, p.Status.ContainerStatuses...) // nolint:gocritic
+	for _, s := range statuses {
+		t := s.State.Terminated
+		if t == nil {
+			t = s.LastTerminationState.Terminated
+		}
+		if t == nil || (t.ExitCode == 0 && t.Reason != "OOMKilled") {
+			continue
+		}
+
+		reason := fmt.Sprintf("container %s terminated with reason %s, exit code %d", s.Name, t.Reason, t.ExitCode)
+		if msg := strings.TrimSpace(t.Message); msg != "" {
+			reason += ": " + msg
+		}
+		reasons = append(reasons, reason)
+	}
+
+	if len(reasons) == 0 {
+		return fmt.Sprintf("pod in phase %s", p.Status.Phase)
+	}
+
+	return strings.Join(reasons, "; ")
+}
+
+// getLastWarningEvent returns the last warning event of the pod
+func getLastWarningEvent(ctx context.Context, cfg Config, pod *apiv1.Pod) string {
+	clientset, err := getKubernetesClientset(cfg)
+	if err != nil {
+		return ""
+	}
+
+	selector := fields.Set{
+		"involvedObject.kind": "Pod",
+		"involvedObject.name": pod.Name,
+		"involvedObject.uid":  string(pod.UID),
+		"type":                apiv1.EventTypeWarning,
+	}.AsSelector().String()
+
+	events, err := clientset.CoreV1().Events(pod.Namespace).List(ctx, metav1.ListOptions{FieldSelector: selector})
+	if err != nil || len(events.Items) == 0 {
+		return ""
+	}
+
+	last := getLastEvent(events.Items)
+
+	return fmt.Sprintf("%s: %s", last.Reason, last.Message)
+}
+
+// getLastEvent returns the event, which occurred last
+func getLastEvent(events []apiv1.Event) *apiv1.Event {
+	sort.Slice(events, func(i, j int) bool {
+		return getEventTime(&events[i]).Before(getEventTime(&events[j]))
+	})
+
+	return &events[len(events)-1]
+}
+
+// getEventTime returns the time of the last occurrence of the event.
+// Events of the events.k8s.io API only set the event time, the creation time is the last resort.
+func getEventTime(e *apiv1.Event) time.Time {
+	switch {
+	case !e.LastTimestamp.IsZero():
+		return e.LastTimestamp.Time
+	case !e.EventTime.IsZero():
+		return e.EventTime.Time
+	}
+
+	return e.CreationTimestamp.Time
+}
+
+// getPodTimeout returns an error, if the pod exceeded one of the configured timeouts
+func getPodTimeout(cfg Config, p *apiv1.Pod, wasReady bool) error {
+	timeouts := cfg.Timeouts
+	age := time.Since(p.CreationTimestamp.Time)
+
+	if timeouts.Pending > 0 && p.Status.Phase == apiv1.PodPending && age > timeouts.Pending {
+		return fmt.Errorf("pod is pending for more than %s", timeouts.Pending)
+	}
+
+	switch p.Labels["externalcc-type"] {
+	case "builder":
+		if timeouts.Build > 0 && age > timeouts.Build {
+			return fmt.Errorf("build takes longer than %s", timeouts.Build)
+		}
+	case "launcher":
+		if timeouts.Startup > 0 && !wasReady && age > timeouts.Startup {
+			return fmt.Errorf("chaincode is not ready after %s", timeouts.Startup)
+		}
+	}
+
+	return nil
+}
+
+// isPodReady returns true, if all containers of the pod are ready
+func isPodReady(p *apiv1.Pod) bool {
+	for _, c := range p.Status.Conditions {
+		if c.Type == apiv1.ContainersReady {
+			return c.Status == apiv1.ConditionTrue
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestGetLastEvent(t *testing.T) {
+	now := time.Now()
+	repeated := apiv1.Event{
+		ObjectMeta:    metav1.ObjectMeta{Name: "repeated", CreationTimestamp: metav1.Time{Time: now.Add(-time.Hour)}},
+		LastTimestamp: metav1.Time{Time: now.Add(-time.Minute)},
+	}
+	eventsAPI := apiv1.Event{
+		ObjectMeta: metav1.ObjectMeta{Name: "events-api", CreationTimestamp: metav1.Time{Time: now.Add(-10 * time.Minute)}},
+		EventTime:  metav1.MicroTime{Time: now.Add(-10 * time.Second)},
+	}
+	created := apiv1.Event{
+		ObjectMeta: metav1.ObjectMeta{Name: "created", CreationTimestamp: metav1.Time{Time: now.Add(-5 * time.Second)}},
+	}
+
+	tests := []struct {
+		name   string
+		events []apiv1.Event
+		want   string
+	}{
+		{name: "last timestamp over creation time", events: []apiv1.Event{repeated, {ObjectMeta: metav1.ObjectMeta{Name: "old", CreationTimestamp: metav1.Time{Time: now.Add(-30 * time.Minute)}}}}, want: "repeated"},
+		{name: "event time of the events API", events: []apiv1.Event{eventsAPI, repeated}, want: "events-api"},
+		{name: "creation time as last resort", events: []apiv1.Event{created, eventsAPI, repeated}, want: "created"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := getLastEvent(tt.events); got.Name != tt.want {
+				t.Errorf("getLastEvent() = %s, want %s", got.Name, tt.want)
+			}
+		})
+	}
+}
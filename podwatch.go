@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/pkg/errors"
+	apiv1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/watch"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+)
+
+const (
+	podCheckPeriod = 10 * time.Second
+	podRetryDelay  = 2 * time.Second
+)
+
+// podWatcher follows a single pod. It starts with the current state of the pod and
+// resumes the watch from the last seen resource version, so no state change is missed.
+type podWatcher struct {
+	pods     typedcorev1.PodInterface
+	name     string
+	evaluate func(p *apiv1.Pod) (done bool, err error)
+
+	last            *apiv1.Pod
+	resourceVersion string // empty, if the state must be read again
+}
+
+// newPodWatcher returns a watcher, which passes every state of the pod to evaluate until it returns done
+func newPodWatcher(pods typedcorev1.PodInterface, name string, evaluate func(p *apiv1.Pod) (bool, error)) *podWatcher {
+	return &podWatcher{
+		pods:     pods,
+		name:     name,
+		evaluate: evaluate,
+	}
+}
+
+// run watches the pod until evaluate returns done, the pod got deleted or the context is canceled
+func (w *podWatcher) run(ctx context.Context) error {
+	// Periodically evaluate the last state, timeouts do not cause an update of the pod
+	ticker := time.NewTicker(podCheckPeriod)
+	defer ticker.Stop()
+
+	for {
+		var done bool
+		var err error
+		if w.resourceVersion == "" {
+			done, err = w.sync(ctx)
+		} else {
+			done, err = w.watch(ctx, ticker.C)
+		}
+		if done {
+			return err
+		}
+
+		// Retry temporary errors of the API server after a short delay
+		if err != nil {
+			log.Printf("Watching pod %s: %s", w.name, err)
+			select {
+			case <-time.After(podRetryDelay):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	}
+}
+
+// sync reads and evaluates the current state of the pod
+func (w *podWatcher) sync(ctx context.Context) (bool, error) {
+	p, err := w.pods.Get(ctx, w.name, metav1.GetOptions{})
+	switch {
+	case ctx.Err() != nil:
+		return true, ctx.Err()
+	case k8serrors.IsNotFound(err):
+		log.Printf("Pod %s got deleted", w.name)
+		return true, errors.New("pod got deleted")
+	case err != nil:
+		return false, errors.Wrap(err, "getting pod")
+	}
+
+	return w.update(p)
+}
+
+// watch evaluates the changes of the pod until the watch ends
+func (w *podWatcher) watch(ctx context.Context, tick <-chan time.Time) (bool, error) {
+	watcher, err := w.pods.Watch(ctx, metav1.ListOptions{
+		FieldSelector:       fields.OneTermEqualSelector("metadata.name", w.name).String(),
+		ResourceVersion:     w.resourceVersion,
+		AllowWatchBookmarks: true,
+	})
+	if err != nil {
+		if ctx.Err() != nil {
+			return true, ctx.Err()
+		}
+		// The resource version may be too old, so we start over with the current state
+		w.resourceVersion = ""
+		return false, errors.Wrap(err, "starting watch")
+	}
+	defer watcher.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return true, ctx.Err()
+		case <-tick:
+			if done, err := w.evaluate(w.last); done {
+				return true, err
+			}
+		case event, ok := <-watcher.ResultChan():
+			if !ok {
+				// The API server closed the watch, it is resumed from the last resource version
+				return false, nil
+			}
+
+			switch event.Type {
+			case watch.Added, watch.Modified:
+				p, ok := event.Object.(*apiv1.Pod)
+				if !ok {
+					return false, fmt.Errorf("unexpected object %T in watch", event.Object)
+				}
+				if done, err := w.update(p); done {
+					return true, err
+				}
+			case watch.Deleted:
+				phase := w.last.Status.Phase
+				if p, ok := event.Object.(*apiv1.Pod); ok {
+					phase = p.Status.Phase
+				}
+				log.Printf("Pod %s, phase %s got deleted", w.name, phase)
+				return true, fmt.Errorf("pod got deleted in phase %s", phase)
+			case watch.Bookmark:
+				if p, ok := event.Object.(*apiv1.Pod); ok {
+					w.resourceVersion = p.ResourceVersion
+				}
+			case watch.Error:
+				// Usually the resource version expired (410 Gone), so we start over with the current state
+				w.resourceVersion = ""
+				return false, errors.Wrap(k8serrors.FromObject(event.Object), "watch failed")
+			}
+		}
+	}
+}
+
+// update evaluates a new state of the pod
+func (w *podWatcher) update(p *apiv1.Pod) (bool, error) {
+	log.Printf("Received update on pod %s, phase %s", p.Name, p.Status.Phase)
+	w.last = p
+	w.resourceVersion = p.ResourceVersion
+
+	return w.evaluate(p)
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	apiv1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// specHashAnnotation is the hash of the chaincode pod, which is compared with the pod of the next run
+const specHashAnnotation = metadataPrefix + "spec-hash"
+
+// reconcileChaincodePod checks the existing pod with the name of the chaincode pod, e.g. after a restart of the peer.
+// A pod, which runs the same chaincode with the same spec without TLS, is returned to be adopted.
+// Other pods are deleted and nil is returned, once they are gone.
+func reconcileChaincodePod(ctx context.Context, cfg Config, runConfig *ChaincodeRunConfig) (*apiv1.Pod, error) {
+	// Setup kubernetes client
+	clientset, err := getKubernetesClientset(cfg)
+	if err != nil {
+		return nil, errors.Wrap(err, "getting kubernetes clientset")
+	}
+	pods := clientset.CoreV1().Pods(cfg.Namespace)
+
+	peer, err := getPeerPod(ctx, cfg)
+	if err != nil {
+		return nil, errors.Wrap(err, "getting myself Pod")
+	}
+	name, err := getLauncherPodName(cfg, peer.Name, runConfig.CCID, runConfig.MSPID)
+	if err != nil {
+		return nil, errors.Wrap(err, "getting chaincode pod name")
+	}
+
+	existing, err := pods.Get(ctx, name, metav1.GetOptions{})
+	switch {
+	case k8serrors.IsNotFound(err):
+		return nil, nil
+	case err != nil:
+		return nil, errors.Wrap(err, "getting existing chaincode pod")
+	}
+
+	hash, err := getChaincodePodHash(cfg, runConfig, peer)
+	if err != nil {
+		return nil, err
+	}
+	reason := getReplaceReason(cfg, existing, runConfig.Image, hash)
+	if reason == "" && runConfig.ClientCert != "" {
+		// The running chaincode keeps the key pair of its launch, which the restarted peer does not accept
+		reason = "the peer issues a new TLS key pair for every launch"
+	}
+	if reason == "" && cfg.Launcher.Artifacts == ArtifactsSecret {
+		_, err = clientset.CoreV1().Secrets(cfg.Namespace).Get(ctx, getArtifactsSecretName(existing), metav1.GetOptions{})
+		if k8serrors.IsNotFound(err) {
+			reason = "its artifacts secret is missing"
+		} else if err != nil {
+			return nil, errors.Wrap(err, "getting artifacts secret")
+		}
+	}
+	if reason == "" {
+		log.Printf("Adopting chaincode pod %s, phase %s", existing.Name, existing.Status.Phase)
+		return existing, nil
+	}
+
+	log.Printf("Replacing chaincode pod %s, as %s", existing.Name, reason)
+	opts := metav1.DeleteOptions{Preconditions: metav1.NewUIDPreconditions(string(existing.UID))}
+	if grace := cfg.Timeouts.DeletionGracePeriod; grace != nil {
+		opts.GracePeriodSeconds = Int64Ref(int64(grace.Seconds()))
+	}
+	err = pods.Delete(ctx, existing.Name, opts)
+	if err != nil && !k8serrors.IsNotFound(err) {
+		return nil, errors.Wrap(err, "deleting existing chaincode pod")
+	}
+
+	// The watch ends with an error, when the pod is gone
+	_ = newPodWatcher(pods, existing.Name, func(p *apiv1.Pod) (bool, error) {
+		return p.UID != existing.UID, nil
+	}).run(ctx)
+	if ctx.Err() != nil {
+		return nil, errors.Wrap(ctx.Err(), "waiting for deletion of existing chaincode pod")
+	}
+
+	return nil, nil
+}
+
+// getReplaceReason returns why the existing pod cannot be adopted, or an empty string
+func getReplaceReason(cfg Config, existing *apiv1.Pod, image, hash string) string {
+	switch {
+	case existing.DeletionTimestamp != nil:
+		return "it is terminating"
+	case existing.Status.Phase == apiv1.PodFailed || existing.Status.Phase == apiv1.PodSucceeded:
+		return "it terminated"
+	case len(existing.Status.ContainerStatuses) > 0 && existing.Status.ContainerStatuses[0].State.Terminated != nil:
+		return "its chaincode container terminated"
+	case len(existing.Spec.Containers) == 0 || existing.Spec.Containers[0].Image != image:
+		return fmt.Sprintf("the image changed to %s", image)
+	case existing.Annotations[specHashAnnotation] != hash:
+		return "its spec or artifacts changed"
+	case cfg.Transfer.Mode == TransferModeExec && !isTransferCompleted(existing):
+		return "the transfer into the pod did not complete"
+	}
+
+	return ""
+}
+
+// isTransferCompleted returns true, if the init container of the transfer mode exec completed
+func isTransferCompleted(p *apiv1.Pod) bool {
+	for _, c := range p.Status.InitContainerStatuses {
+		if c.Name == transferContainerName {
+			return c.State.Terminated != nil && c.State.Terminated.ExitCode == 0
+		}
+	}
+
+	return false
+}
+
+// newHashedChaincodePod returns the chaincode pod annotated with its hash
+func newHashedChaincodePod(cfg Config, runConfig *ChaincodeRunConfig, transferPVPrefix string, peer *apiv1.Pod) (*apiv1.Pod, error) {
+	pod, err := newChaincodePod(cfg, runConfig, transferPVPrefix, peer)
+	if err != nil {
+		return nil, err
+	}
+
+	hash, err := getChaincodePodHash(cfg, runConfig, peer)
+	if err != nil {
+		return nil, err
+	}
+	pod.Annotations[specHashAnnotation] = hash
+
+	return pod, nil
+}
+
+// getChaincodePodHash returns the hash of the chaincode pod, e.g. its image, environment, resources and template.
+// The transfer directory and the TLS artifacts differ with every run and are not part of the hash.
+func getChaincodePodHash(cfg Config, runConfig *ChaincodeRunConfig, peer *apiv1.Pod) (string, error) {
+	pod, err := newChaincodePod(cfg, runConfig, "transfer", peer)
+	if err != nil {
+		return "", err
+	}
+
+	h := sha256.New()
+	err = json.NewEncoder(h).Encode(pod)
+	if err != nil {
+		return "", errors.Wrap(err, "hashing chaincode pod")
+	}
+
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// watchAdoptedPod watches a chaincode pod of a previous run until it completes or fails.
+// Afterwards it deletes the pod and the transfer directory, which the previous run left behind.
+func watchAdoptedPod(ctx context.Context, cfg Config, runConfig *ChaincodeRunConfig, pod *apiv1.Pod) error {
+	if dir := getTransferDir(cfg, pod); dir != "" {
+		defer func() {
+			log.Printf("Deleting transfer directory %s of the previous run", dir)
+			err := os.RemoveAll(dir)
+			if err != nil {
+				log.Println(err.Error() + "\n failed to delete transfer directory")
+			}
+		}()
+	}
+	defer cleanupPodSilent(cfg, pod) // Cleanup pod on finish
+
+	err := watchPodUntilCompletion(ctx, cfg, pod)
+	if err != nil {
+		return errors.Wrapf(err, "chaincode %s in Pod %s failed", runConfig.CCID, pod.Name)
+	}
+
+	return nil
+}
+
+// getTransferDir returns the directory on the transfer volume, which is mounted by the pod, or an empty string
+func getTransferDir(cfg Config, pod *apiv1.Pod) string {
+	if cfg.Transfer.Mode == TransferModeExec || cfg.TransferVolume.Path == "" {
+		return ""
+	}
+
+	for _, c := range pod.Spec.Containers {
+		for _, m := range c.VolumeMounts {
+			if m.Name != "transfer-pv" || m.SubPath == "" {
+				continue
+			}
+			prefix := strings.SplitN(m.SubPath, "/", 2)[0]
+			if prefix == "" || prefix == "." || prefix == ".." {
+				continue
+			}
+			return filepath.Join(cfg.TransferVolume.Path, prefix)
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"testing"
+
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestGetChaincodePodHash(t *testing.T) {
+	cfg := Config{}
+	peer := &apiv1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "peer0", Namespace: "fabric", UID: "1234"}}
+	base := ChaincodeRunConfig{
+		CCID:        "mycc:afb437d0b8b4a8b3a5c1f5e7e3a0d1c9afb437d0b8b4a8b3a5c1f5e7e3a0d1c9",
+		PeerAddress: "peer0:7052",
+		ClientCert:  "client certificate of the first launch",
+		ClientKey:   "client key of the first launch",
+		RootCert:    "root certificate",
+		MSPID:       "Org1MSP",
+		Image:       "hyperledger/fabric-ccenv:2.2",
+		Platform:    "golang",
+	}
+
+	tests := []struct {
+		name   string
+		change func(c *ChaincodeRunConfig)
+		equal  bool
+	}{
+		{name: "same launch", change: func(c *ChaincodeRunConfig) {}, equal: true},
+		{
+			name: "new TLS key pair",
+			change: func(c *ChaincodeRunConfig) {
+				c.ClientCert = "client certificate of the second launch"
+				c.ClientKey = "client key of the second launch"
+			},
+			equal: true,
+		},
+		{name: "other image", change: func(c *ChaincodeRunConfig) { c.Image = "hyperledger/fabric-ccenv:2.3" }, equal: false},
+		{name: "other peer address", change: func(c *ChaincodeRunConfig) { c.PeerAddress = "peer1:7052" }, equal: false},
+	}
+
+	want, err := getChaincodePodHash(cfg, &base, peer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			runConfig := base
+			tt.change(&runConfig)
+
+			got, err := getChaincodePodHash(cfg, &runConfig, peer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (got == want) != tt.equal {
+				t.Errorf("hash equal = %t, want %t", got == want, tt.equal)
+			}
+		})
+	}
+}
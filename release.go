@@ -11,7 +11,7 @@ import (
 )
 
 // Release copies the META-INF data from the chaincode source to the release directory
-// on the peer
+// on the peer. In ccaas mode it launches the chaincode and writes its connection.json.
 func Release(ctx context.Context, cfg Config) error {
 	log.Println("Procedure: release")
 
@@ -33,5 +33,13 @@ func Release(ctx context.Context, cfg Config) error {
 		}
 	}
 
+	// Launch chaincode as a service, the peer will not call run in this case
+	if cfg.Launcher.Mode == LauncherModeCCaaS {
+		err := ReleaseCCaaS(ctx, cfg, sourceDir, outputDir)
+		if err != nil {
+			return errors.Wrap(err, "releasing chaincode as a service")
+		}
+	}
+
 	return nil
 }
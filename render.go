@@ -0,0 +1,350 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/scheme"
+)
+
+const (
+	renderTransferPrefix = "transfer"
+	redactedValue        = "<redacted>"
+)
+
+// renderer collects the objects, which the procedures build and run would create
+type renderer struct {
+	cfg         Config
+	peer        *apiv1.Pod
+	mspid       string
+	peerAddress string
+	objects     []runtime.Object
+}
+
+// Render prints the builder and chaincode pods with their Secrets and Services as YAML without contacting the API server.
+// The objects are created by the same functions as in the procedures build, release and run.
+func Render(ctx context.Context, cfg Config) error {
+	myself, _ := os.Hostname()
+	r := renderer{cfg: cfg}
+
+	flags := flag.NewFlagSet("render", flag.ContinueOnError)
+	pkg := flags.String("package", "", "chaincode package (.tar.gz) to render the builder and chaincode objects for")
+	metadataDir := flags.String("metadata", "", "directory with the metadata.json passed to build")
+	sourceDir := flags.String("source", "", "directory with the chaincode source passed to build")
+	chaincodeDir := flags.String("chaincode", "", "directory with the chaincode.json passed to run")
+	outputDir := flags.String("build-output", "", "directory with the k8scc_buildinfo.json, defaults to -chaincode")
+	peer := flags.String("peer", myself, "name of the peer pod")
+	flags.StringVar(&r.mspid, "mspid", getPeerMSPID(), "MSP ID of the peer")
+	flags.StringVar(&r.peerAddress, "peer-address", "peer:7052", "chaincode address of the peer used with -package")
+
+	err := flags.Parse(getCommandArgs("render"))
+	if err != nil {
+		return err
+	}
+
+	// Outside of Kubernetes, the namespace is only available from the configuration or the kubeconfig
+	if cfg.Namespace == "" {
+		log.Println("No namespace configured, rendering the objects of the peer namespace without namespace")
+	}
+	r.peer = &apiv1.Pod{ObjectMeta: metav1.ObjectMeta{Name: *peer, Namespace: cfg.Namespace}}
+
+	// The procedure build reads the MSP ID from the environment of the peer
+	err = os.Setenv("CORE_PEER_LOCALMSPID", r.mspid)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case *pkg != "":
+		err = r.renderPackage(*pkg)
+	case *metadataDir != "":
+		_, err = r.renderBuilder(*metadataDir, *sourceDir, "")
+	case *chaincodeDir != "":
+		if *outputDir == "" {
+			*outputDir = *chaincodeDir
+		}
+		err = r.renderChaincode(*chaincodeDir, *outputDir)
+	default:
+		err = errors.New("render requires one of -package, -metadata or -chaincode")
+	}
+	if err != nil {
+		return err
+	}
+
+	return printObjects(os.Stdout, r.objects)
+}
+
+// renderPackage renders the objects of the build and the launch of a chaincode package
+func (r *renderer) renderPackage(pkg string) error {
+	dir, err := ioutil.TempDir("", "k8scc-render")
+	if err != nil {
+		return errors.Wrap(err, "creating temporary directory")
+	}
+	defer os.RemoveAll(dir)
+
+	hash, err := extractChaincodePackage(pkg, dir)
+	if err != nil {
+		return errors.Wrapf(err, "extracting chaincode package %s", pkg)
+	}
+
+	metadataDir := filepath.Join(dir, "metadata")
+	metadata, err := getMetadata(metadataDir)
+	if err != nil {
+		return errors.Wrap(err, "getting metadata for chaincode")
+	}
+	ccid := fmt.Sprintf("%s:%s", metadata.Label, hash)
+
+	buildInformation, err := r.renderBuilder(metadataDir, filepath.Join(dir, "src"), ccid)
+	if err != nil {
+		return err
+	}
+
+	runConfig := &ChaincodeRunConfig{
+		CCID:        ccid,
+		PeerAddress: r.peerAddress,
+		MSPID:       r.mspid,
+		Image:       buildInformation.Image,
+		Platform:    buildInformation.Platform,
+		SourceHash:  buildInformation.SourceHash,
+	}
+
+	return r.renderLauncher(runConfig, buildInformation)
+}
+
+// renderBuilder renders the builder pod or job like the procedure build and returns the resulting build information
+func (r *renderer) renderBuilder(metadataDir, sourceDir, ccid string) (*BuildInformation, error) {
+	metadata, err := getMetadata(metadataDir)
+	if err != nil {
+		return nil, errors.Wrap(err, "getting metadata for chaincode")
+	}
+
+	cfg, err := r.cfg.ForChaincode(metadata.Label, r.mspid)
+	if err != nil {
+		return nil, errors.Wrap(err, "applying overrides")
+	}
+	cfg, err = cfg.ForBuilder()
+	if err != nil {
+		return nil, errors.Wrap(err, "getting target of builder pods")
+	}
+	metadata.Label = strings.ToLower(metadata.Label)
+	metadata.CCID = ccid
+
+	if sourceDir != "" {
+		metadata.SourceHash, err = hashSource(sourceDir)
+		if err != nil {
+			return nil, errors.Wrap(err, "hashing chaincode source")
+		}
+	}
+	metadata.PackageHash = getPackageHash(metadata)
+
+	// Packages with a prebuilt image are not built on Kubernetes
+	if IsPrebuiltImage(metadata.Type) {
+		if sourceDir == "" {
+			return nil, errors.New("prebuilt images require the chaincode source")
+		}
+		image, err := getChaincodeImage(sourceDir)
+		if err != nil {
+			return nil, errors.Wrap(err, "getting chaincode image")
+		}
+		return &BuildInformation{Image: image.Reference(), Platform: metadata.Type, SourceHash: metadata.SourceHash}, nil
+	}
+
+	if cfg.Builder.Kind == BuilderKindJob {
+		job, err := newBuilderJob(cfg, metadata, renderTransferPrefix, r.peer)
+		if err != nil {
+			return nil, err
+		}
+		r.add(cfg.Namespace, job)
+	} else {
+		pod, err := newBuilderPod(cfg, metadata, renderTransferPrefix, r.peer)
+		if err != nil {
+			return nil, err
+		}
+		r.add(cfg.Namespace, pod)
+	}
+
+	return &BuildInformation{Image: cfg.Images[metadata.Type], Platform: metadata.Type, SourceHash: metadata.SourceHash}, nil
+}
+
+// renderChaincode renders the chaincode objects for the chaincode.json and build output passed to run
+func (r *renderer) renderChaincode(metadataDir, outputDir string) error {
+	runConfig, err := getChaincodeRunConfig(metadataDir, outputDir)
+	if err != nil {
+		return errors.Wrap(err, "getting run config for chaincode")
+	}
+	r.mspid = runConfig.MSPID
+
+	buildInformation := &BuildInformation{
+		Image:      runConfig.Image,
+		Platform:   runConfig.Platform,
+		SourceHash: runConfig.SourceHash,
+	}
+
+	return r.renderLauncher(runConfig, buildInformation)
+}
+
+// renderLauncher renders the chaincode pod and Secret like the procedure run or the Deployment
+// and Service of a chaincode as a service like the procedure release
+func (r *renderer) renderLauncher(runConfig *ChaincodeRunConfig, buildInformation *BuildInformation) error {
+	cfg, err := r.cfg.ForChaincode(getChaincodeLabel(runConfig.CCID), runConfig.MSPID)
+	if err != nil {
+		return errors.Wrap(err, "applying overrides")
+	}
+	cfg, err = cfg.ForLauncher()
+	if err != nil {
+		return errors.Wrap(err, "getting target of chaincode")
+	}
+
+	if cfg.Launcher.Mode == LauncherModeCCaaS {
+		name, err := getLauncherPodName(cfg, r.peer.Name, runConfig.CCID, runConfig.MSPID)
+		if err != nil {
+			return errors.Wrap(err, "getting chaincode name")
+		}
+
+		port := cfg.Launcher.CCaaS.Port
+		if port == 0 {
+			port = defaultCCaaSPort
+		}
+
+		info := getCCaaSInfo(name, runConfig.CCID, runConfig.MSPID, r.peer, buildInformation)
+		deployment, err := newChaincodeDeployment(cfg, info, buildInformation, filepath.Join("ccaas", name), port)
+		if err != nil {
+			return err
+		}
+		r.add(cfg.Namespace, deployment)
+		r.add(cfg.Namespace, newChaincodeService(cfg, info, port))
+
+		// The TLS material is read by the procedure release, only its files are rendered
+		if tlsCfg := cfg.Launcher.CCaaS.TLS; tlsCfg.Enabled && cfg.Launcher.Artifacts == ArtifactsSecret {
+			artifacts := &CCaaSArtifacts{ServerCert: redactedValue, ServerKey: redactedValue}
+			if tlsCfg.ClientAuth {
+				artifacts.ClientRootCert = redactedValue
+			}
+			r.add(cfg.Namespace, redactSecret(newCCaaSArtifactsSecret(deployment, artifacts)))
+		}
+		return nil
+	}
+
+	pod, err := newHashedChaincodePod(cfg, runConfig, renderTransferPrefix, r.peer)
+	if err != nil {
+		return err
+	}
+	r.add(cfg.Namespace, pod)
+
+	if cfg.Launcher.Artifacts == ArtifactsSecret {
+		r.add(cfg.Namespace, redactSecret(newArtifactsSecret(runConfig, pod)))
+	}
+
+	return nil
+}
+
+// add adds the object in the namespace, in which the procedure would create it
+func (r *renderer) add(namespace string, obj runtime.Object) {
+	if o, ok := obj.(metav1.Object); ok && o.GetNamespace() == "" {
+		o.SetNamespace(namespace)
+	}
+	r.objects = append(r.objects, obj)
+}
+
+// redactSecret replaces the values of the Secret, so the keys and certificates of the peer are not printed
+func redactSecret(secret *apiv1.Secret) *apiv1.Secret {
+	secret.StringData = make(map[string]string, len(secret.Data))
+	for key := range secret.Data {
+		secret.StringData[key] = redactedValue
+	}
+	secret.Data = nil
+
+	return secret
+}
+
+// printObjects prints the objects as YAML documents with their kind and API version
+func printObjects(w io.Writer, objects []runtime.Object) error {
+	for _, obj := range objects {
+		kinds, _, err := scheme.Scheme.ObjectKinds(obj)
+		if err != nil {
+			return errors.Wrap(err, "getting kind of object")
+		}
+		obj.GetObjectKind().SetGroupVersionKind(kinds[0])
+
+		// The JSON representation omits empty fields, the MapSlice keeps the order of the fields
+		data, err := json.Marshal(obj)
+		if err != nil {
+			return errors.Wrap(err, "marshaling object")
+		}
+		fields := yaml.MapSlice{}
+		err = yaml.Unmarshal(data, &fields)
+		if err != nil {
+			return errors.Wrap(err, "converting object")
+		}
+		data, err = yaml.Marshal(fields)
+		if err != nil {
+			return errors.Wrap(err, "marshaling object as YAML")
+		}
+
+		fmt.Fprintln(w, "---")
+		_, err = w.Write(data)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// extractChaincodePackage extracts the metadata.json into dir/metadata/ and the code into dir/src/.
+// It returns the hash of the package, which is part of the package ID.
+func extractChaincodePackage(pkg, dir string) (string, error) {
+	data, err := ioutil.ReadFile(pkg) // #nosec G304
+	if err != nil {
+		return "", err
+	}
+
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+	tr := tar.NewReader(gz)
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+
+		switch hdr.Name {
+		case "metadata.json":
+			err = writeFileFromTar(tr, filepath.Join(dir, "metadata", "metadata.json"), 0600)
+		case "code.tar.gz":
+			var code *gzip.Reader
+			code, err = gzip.NewReader(tr)
+			if err == nil {
+				err = untarDirectory(code, filepath.Join(dir, "src"))
+			}
+		}
+		if err != nil {
+			return "", errors.Wrapf(err, "extracting %s", hdr.Name)
+		}
+	}
+
+	return fmt.Sprintf("%x", sha256.Sum256(data)), nil
+}
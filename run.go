@@ -8,11 +8,9 @@ import (
 	"log"
 	"os"
 	"path/filepath"
-	"strings"
 	cpy "github.com/otiai10/copy"
 	"github.com/pkg/errors"
 	apiv1 "k8s.io/api/core/v1"
-	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 // Run implements the chaincode launcher on Kubernetes whose function is implemented after
@@ -29,6 +27,28 @@ func Run(ctx context.Context, cfg Config) error {
 	if err != nil {
 		return errors.Wrap(err, "getting run config for chaincode")
 	}
+	// Apply per chaincode configuration
+	cfg, err = cfg.ForChaincode(getChaincodeLabel(runConfig.CCID), runConfig.MSPID)
+	if err != nil {
+		return errors.Wrap(err, "applying overrides")
+	}
+	// The chaincode pods may run in another namespace or cluster
+	cfg, err = cfg.ForLauncher()
+	if err != nil {
+		return errors.Wrap(err, "getting target of chaincode pods")
+	}
+	// Adopt the pod of a previous run, e.g. after a restart of the peer, or replace it
+	adopted, err := reconcileChaincodePod(ctx, cfg, runConfig)
+	if err != nil {
+		return errors.Wrap(err, "reconciling existing chaincode pod")
+	}
+	if adopted != nil {
+		return watchAdoptedPod(ctx, cfg, runConfig, adopted)
+	}
+	// Transfer data using exec instead of the transfer PV
+	if cfg.Transfer.Mode == TransferModeExec {
+		return runWithExecTransfer(ctx, cfg, runConfig, outputDir)
+	}
 	// Create transfer dir
 	copyOpts := cpy.Options{AddPermission: os.ModePerm}
 	prefix, _ := os.Hostname()
@@ -66,79 +86,97 @@ func Run(ctx context.Context, cfg Config) error {
 	if err != nil {
 		return errors.Wrap(err, "chmod on artifacts dir in the transfer dir")
 	}
-	// Create artifacts
-	err = createArtifacts(runConfig, transferArtifacts)
-	if err != nil {
-		return errors.Wrap(err, "creating artifacts")
+	// Create artifacts, unless they are delivered in a Secret
+	if cfg.Launcher.Artifacts != ArtifactsSecret {
+		err = createArtifacts(runConfig, transferArtifacts)
+		if err != nil {
+			return errors.Wrap(err, "creating artifacts")
+		}
 	}
 	// Create chaincode pod
 	pod, err := createChaincodePod(ctx, cfg, runConfig, filepath.Base(transferdir))
 	if err != nil {
 		return errors.Wrap(err, "creating chaincode pod")
 	}
-	defer cleanupPodSilent(pod) // Cleanup pod on finish
+	defer cleanupPodSilent(cfg, pod) // Cleanup pod on finish
 	// Watch chaincode Pod for completion or failure
-	podSucceeded, err := watchPodUntilCompletion(ctx, pod)
+	err = watchPodUntilCompletion(ctx, cfg, pod)
 	if err != nil {
-		return errors.Wrap(err, "watching chaincode pod")
-	}
-	if !podSucceeded {
-		return fmt.Errorf("chaincode %s in Pod %s failed", runConfig.CCID, pod.Name)
+		return errors.Wrapf(err, "chaincode %s in Pod %s failed", runConfig.CCID, pod.Name)
 	}
 	return nil
 }
-func createArtifacts(c *ChaincodeRunConfig, dir string) error {
-	clientCertPath := filepath.Join(dir, "client.crt")
-	clientKeyPath := filepath.Join(dir, "client.key")
-	clientCertFile := filepath.Join(dir, "client_pem.crt")
-	clientKeyFile := filepath.Join(dir, "client_pem.key")
-	peerCertFile := filepath.Join(dir, "root.crt")
-	// Create cert files
-	err := ioutil.WriteFile(clientCertFile, []byte(c.ClientCert), os.ModePerm)
-	if err != nil {
-		return errors.Wrap(err, "writing client cert pem file")
-	}
-	err = ioutil.WriteFile(clientKeyFile, []byte(c.ClientKey), os.ModePerm)
+func runWithExecTransfer(ctx context.Context, cfg Config, runConfig *ChaincodeRunConfig, outputDir string) error {
+	// Create artifacts in a local temporary directory
+	artifactsDir, err := ioutil.TempDir("", "k8scc")
 	if err != nil {
-		return errors.Wrap(err, "writing client key pem file")
+		return errors.Wrap(err, "creating artifacts dir")
 	}
-	err = ioutil.WriteFile(peerCertFile, []byte(c.RootCert), os.ModePerm)
+	defer os.RemoveAll(artifactsDir)
+	err = createArtifacts(runConfig, artifactsDir)
 	if err != nil {
-		return errors.Wrap(err, "writing peer cert file")
+		return errors.Wrap(err, "creating artifacts")
 	}
-	// Create weird cert files (used by node platform)
-	// https://github.com/hyperledger/fabric/blob/v2.2.1/core/container/dockercontroller/dockercontroller.go#L319
-	err = ioutil.WriteFile(clientCertPath, []byte(base64.StdEncoding.EncodeToString([]byte(c.ClientCert))), os.ModePerm)
+	// Create chaincode pod
+	pod, err := createChaincodePod(ctx, cfg, runConfig, "transfer")
 	if err != nil {
-		return errors.Wrap(err, "writing client cert file")
+		return errors.Wrap(err, "creating chaincode pod")
 	}
-	err = ioutil.WriteFile(clientKeyPath, []byte(base64.StdEncoding.EncodeToString([]byte(c.ClientKey))), os.ModePerm)
+	defer cleanupPodSilent(cfg, pod) // Cleanup pod on finish
+	// Watch chaincode Pod for completion or failure, while the data is transferred
+	watched := watchPodInBackground(ctx, cfg, pod)
+	err = waitForContainerRunning(ctx, cfg, pod, transferContainerName)
 	if err != nil {
-		return errors.Wrap(err, "writing client key file")
+		return errors.Wrap(err, "waiting for transfer container")
 	}
-	// Change permissions
-	err = os.Chmod(clientCertFile, os.ModePerm)
-	if err != nil {
-		return errors.Wrap(err, "changing client cert pem file permissions")
+	if cfg.Launcher.Artifacts != ArtifactsSecret {
+		err = copyToPod(ctx, cfg, pod, transferContainerName, artifactsDir, "/chaincode/artifacts/")
+		if err != nil {
+			return errors.Wrap(err, "copy artifacts into chaincode pod")
+		}
 	}
-	err = os.Chmod(clientKeyFile, os.ModePerm)
-	if err != nil {
-		return errors.Wrap(err, "changing client key pem file permissions")
+	if !IsPrebuiltImage(runConfig.Platform) {
+		err = copyToPod(ctx, cfg, pod, transferContainerName, outputDir, GetCCMountDir(runConfig.Platform))
+		if err != nil {
+			return errors.Wrap(err, "copy output dir into chaincode pod")
+		}
 	}
-	err = os.Chmod(clientCertPath, os.ModePerm)
+	err = touchInPod(ctx, cfg, pod, transferContainerName, transferReadyFile)
 	if err != nil {
-		return errors.Wrap(err, "changing client key file permissions")
+		return errors.Wrap(err, "starting chaincode")
 	}
-	err = os.Chmod(clientKeyPath, os.ModePerm)
+	err = <-watched
 	if err != nil {
-		return errors.Wrap(err, "changing client key file permissions")
+		return errors.Wrapf(err, "chaincode %s in Pod %s failed", runConfig.CCID, pod.Name)
 	}
-	err = os.Chmod(peerCertFile, os.ModePerm)
-	if err != nil {
-		return errors.Wrap(err, "changing peer cert file permissions")
+	return nil
+}
+func createArtifacts(c *ChaincodeRunConfig, dir string) error {
+	for name, data := range getArtifacts(c) {
+		path := filepath.Join(dir, name)
+		err := ioutil.WriteFile(path, data, os.ModePerm)
+		if err != nil {
+			return errors.Wrapf(err, "writing %s", name)
+		}
+		// Change permissions, as the umask is applied on write
+		err = os.Chmod(path, os.ModePerm)
+		if err != nil {
+			return errors.Wrapf(err, "changing permissions of %s", name)
+		}
 	}
 	return nil
 }
+func getArtifacts(c *ChaincodeRunConfig) map[string][]byte {
+	return map[string][]byte{
+		"client_pem.crt": []byte(c.ClientCert),
+		"client_pem.key": []byte(c.ClientKey),
+		"root.crt":       []byte(c.RootCert),
+		// Create weird cert files (used by node platform)
+		// https://github.com/hyperledger/fabric/blob/v2.2.1/core/container/dockercontroller/dockercontroller.go#L319
+		"client.crt": []byte(base64.StdEncoding.EncodeToString([]byte(c.ClientCert))),
+		"client.key": []byte(base64.StdEncoding.EncodeToString([]byte(c.ClientKey))),
+	}
+}
 func getChaincodeRunConfig(metadataDir string, outputDir string) (*ChaincodeRunConfig, error) {
 	// Read chaincode.json
 	metadataFile := filepath.Join(metadataDir, "chaincode.json")
@@ -151,20 +189,17 @@ func getChaincodeRunConfig(metadataDir string, outputDir string) (*ChaincodeRunC
 	if err != nil {
 		return nil, errors.Wrap(err, "Unmarshaling chaincode.json")
 	}
-	// Create shortname
-	parts := strings.SplitN(metadata.CCID, ":", 2)
-	if len(parts) != 2 {
-		return nil, errors.New("Cannot parse chaincode name")
-	}
-	name := strings.ReplaceAll(parts[0], "_", "-")
-	// make chaincode name lower case
-	name = strings.ToLower(name)
-	hash := parts[1]
-	if len(hash) < 8 {
-		return nil, errors.New("Hash of chaincode ID too short")
-	}
-	metadata.ShortName = fmt.Sprintf("%s-%s", name, hash[0:8])
 	// Read BuildInformation
+	buildInformation, err := getBuildInformation(outputDir)
+	if err != nil {
+		return nil, err
+	}
+	metadata.Image = buildInformation.Image
+	metadata.Platform = buildInformation.Platform
+	metadata.SourceHash = buildInformation.SourceHash
+	return &metadata, nil
+}
+func getBuildInformation(outputDir string) (*BuildInformation, error) {
 	buildInfoFile := filepath.Join(outputDir, "k8scc_buildinfo.json")
 	buildInfoData, err := ioutil.ReadFile(buildInfoFile)
 	if err != nil {
@@ -178,53 +213,78 @@ func getChaincodeRunConfig(metadataDir string, outputDir string) (*ChaincodeRunC
 	if buildInformation.Image == "" {
 		return nil, errors.New("No image found in buildinfo")
 	}
-	metadata.Image = buildInformation.Image
-	metadata.Platform = buildInformation.Platform
-	return &metadata, nil
+	return &buildInformation, nil
 }
 func createChaincodePod(ctx context.Context,
 	cfg Config, runConfig *ChaincodeRunConfig, transferPVPrefix string) (*apiv1.Pod, error) {
 	// Setup kubernetes client
-	clientset, err := getKubernetesClientset()
+	clientset, err := getKubernetesClientset(cfg)
 	if err != nil {
 		return nil, errors.Wrap(err, "getting kubernetes clientset")
 	}
 	// Get peer Pod
-	myself, _ := os.Hostname()
-	myselfPod, err := clientset.CoreV1().Pods(cfg.Namespace).Get(ctx, myself, metav1.GetOptions{})
+	peer, err := getPeerPod(ctx, cfg)
 	if err != nil {
 		return nil, errors.Wrap(err, "getting myself Pod")
 	}
-	// Set resources
-	limits := apiv1.ResourceList{}
-	if limit := cfg.Launcher.Resources.LimitMemory; limit != "" {
-		limits["memory"] = resource.MustParse(limit)
+	// The hash identifies the pod in the next run, existing pods are reconciled by Run before
+	pod, err := newHashedChaincodePod(cfg, runConfig, transferPVPrefix, peer)
+	if err != nil {
+		return nil, err
 	}
-	if limit := cfg.Launcher.Resources.LimitCPU; limit != "" {
-		limits["cpu"] = resource.MustParse(limit)
+	pod, err = clientset.CoreV1().Pods(cfg.Namespace).Create(ctx, pod, metav1.CreateOptions{})
+	if err != nil {
+		return nil, err
 	}
+	// The Secret is owned by the pod, so it is deleted together with the pod
+	if cfg.Launcher.Artifacts == ArtifactsSecret {
+		err = createArtifactsSecret(ctx, cfg, runConfig, pod)
+		if err != nil {
+			cleanupPodSilent(cfg, pod)
+			return nil, errors.Wrap(err, "creating artifacts secret")
+		}
+	}
+	return pod, nil
+}
+
+// newChaincodePod returns the chaincode pod owned by the peer pod
+func newChaincodePod(cfg Config, runConfig *ChaincodeRunConfig, transferPVPrefix string, peer *apiv1.Pod) (*apiv1.Pod, error) {
+	// Set resources
+	limits, err := cfg.Launcher.Resources.Limits()
+	if err != nil {
+		return nil, errors.Wrap(err, "getting chaincode resources")
+	}
+
 	// Configuration
 	hasTLS := "true"
 	if runConfig.ClientCert == "" {
 		hasTLS = "false"
 	}
 	// Pod
-	podname := fmt.Sprintf("%s-cc-%s", myself, runConfig.ShortName)
+	podname, err := getLauncherPodName(cfg, peer.Name, runConfig.CCID, runConfig.MSPID)
+	if err != nil {
+		return nil, errors.Wrap(err, "getting chaincode pod name")
+	}
+	info := ChaincodeInfo{
+		Component:     ComponentLauncher,
+		Instance:      podname,
+		CCID:          runConfig.CCID,
+		Label:         getChaincodeLabel(runConfig.CCID),
+		MSPID:         runConfig.MSPID,
+		Peer:          peer.Name,
+		PeerNamespace: peer.Namespace,
+		PeerUID:       string(peer.UID),
+		PeerAddress:   runConfig.PeerAddress,
+		Platform:      runConfig.Platform,
+		Image:         runConfig.Image,
+		SourceHash:    runConfig.SourceHash,
+	}
 	pod := &apiv1.Pod{
 		ObjectMeta: metav1.ObjectMeta{
-			Name: podname,
-			OwnerReferences: []metav1.OwnerReference{
-				{
-					APIVersion:         "v1",
-					Kind:               "Pod",
-					Name:               myselfPod.Name,
-					UID:                myselfPod.UID,
-					BlockOwnerDeletion: BoolRef(true),
-				},
-			},
-			Labels: map[string]string{
-				"externalcc-type": "launcher",
-			},
+			Name:            podname,
+			OwnerReferences: getPeerOwnerReferences(cfg, peer),
+			Labels:          info.Labels(cfg.Launcher.Labels),
+			Annotations:     info.Annotations(cfg.Launcher.Annotations),
 		},
 		Spec: apiv1.PodSpec{
 			Containers: []apiv1.Container{
@@ -299,13 +359,31 @@ func createChaincodePod(ctx context.Context,
 			},
 		},
 	}
-	// delete pods in state "Completed", "Failed" or "Terminating"
-	existingCCPod, err := clientset.CoreV1().Pods(cfg.Namespace).Get(ctx, podname, metav1.GetOptions{})
-	if existingCCPod != nil && (existingCCPod.Status.Phase == apiv1.PodFailed || existingCCPod.Status.Phase == apiv1.PodSucceeded || (len(existingCCPod.Status.ContainerStatuses) > 0 && existingCCPod.Status.ContainerStatuses[0].State.Terminated != nil)) {
-		err := clientset.CoreV1().Pods(cfg.Namespace).Delete(ctx, podname, metav1.DeleteOptions{})
-		if err != nil {
-			return nil, errors.Wrap(err, "deleting existing chaincode pod")
-		}
+	// Additional environment variables
+	pod.Spec.Containers[0].Env = append(pod.Spec.Containers[0].Env, cfg.Launcher.EnvVars()...)
+	// Prebuilt images are started by their own entrypoint and don't require the build output
+	if IsPrebuiltImage(runConfig.Platform) {
+		container := &pod.Spec.Containers[0]
+		container.Command = nil
+		container.WorkingDir = ""
+		container.VolumeMounts = container.VolumeMounts[:1] // artifacts only
+		container.Env = append(container.Env, apiv1.EnvVar{
+			Name:  "CORE_PEER_ADDRESS",
+			Value: runConfig.PeerAddress,
+		})
+	}
+	// Deliver artifacts in a Secret instead of the transfer volume
+	if cfg.Launcher.Artifacts == ArtifactsSecret {
+		useArtifactsSecret(&pod.Spec, getArtifactsSecretName(pod))
+	}
+	// Transfer data using exec instead of the transfer PV
+	if cfg.Transfer.Mode == TransferModeExec {
+		useExecTransfer(cfg, &pod.Spec, false)
+	}
+	// Customize pod
+	err = applyPodTemplate(cfg.Launcher.PodTemplate, pod)
+	if err != nil {
+		return nil, errors.Wrap(err, "applying launcher pod template")
 	}
-	return clientset.CoreV1().Pods(cfg.Namespace).Create(ctx, pod, metav1.CreateOptions{})
+	return pod, nil
 }
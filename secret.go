@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"log"
+
+	"github.com/pkg/errors"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// ArtifactsTransfer delivers the TLS material of the chaincode using the transfer
+	ArtifactsTransfer = "transfer"
+	// ArtifactsSecret delivers the TLS material of the chaincode in a Secret owned by the chaincode pod
+	ArtifactsSecret = "secret"
+
+	artifactsVolumeName = "artifacts"
+)
+
+func getArtifactsSecretName(pod *apiv1.Pod) string {
+	return pod.Name + "-artifacts"
+}
+
+// useArtifactsSecret mounts the artifacts from a Secret instead of the transfer volume
+func useArtifactsSecret(spec *apiv1.PodSpec, secretName string) {
+	spec.Volumes = append(spec.Volumes, apiv1.Volume{
+		Name: artifactsVolumeName,
+		VolumeSource: apiv1.VolumeSource{
+			Secret: &apiv1.SecretVolumeSource{
+				SecretName:  secretName,
+				DefaultMode: Int32Ref(0400),
+			},
+		},
+	})
+
+	container := &spec.Containers[0]
+	for i := range container.VolumeMounts {
+		m := &container.VolumeMounts[i]
+		if m.MountPath == "/chaincode/artifacts/" {
+			*m = apiv1.VolumeMount{
+				Name:      artifactsVolumeName,
+				MountPath: "/chaincode/artifacts/",
+				ReadOnly:  true,
+			}
+		}
+	}
+}
+
+// createArtifactsSecret creates the Secret with the artifacts of the chaincode pod.
+// The pod waits with the start of its container until the Secret exists.
+func createArtifactsSecret(ctx context.Context, cfg Config, runConfig *ChaincodeRunConfig, pod *apiv1.Pod) error {
+	// Setup kubernetes client
+	clientset, err := getKubernetesClientset(cfg)
+	if err != nil {
+		return errors.Wrap(err, "getting kubernetes clientset")
+	}
+
+	secret := newArtifactsSecret(runConfig, pod)
+	secrets := clientset.CoreV1().Secrets(pod.Namespace)
+
+	// A Secret of a previous pod with the same name is not deleted yet by the garbage collector
+	err = secrets.Delete(ctx, secret.Name, metav1.DeleteOptions{})
+	if err == nil {
+		log.Printf("Deleted existing secret %s", secret.Name)
+	}
+
+	_, err = secrets.Create(ctx, secret, metav1.CreateOptions{})
+	return err
+}
+
+// newArtifactsSecret returns the Secret with the artifacts owned by the chaincode pod
+func newArtifactsSecret(runConfig *ChaincodeRunConfig, pod *apiv1.Pod) *apiv1.Secret {
+	return &apiv1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            getArtifactsSecretName(pod),
+			OwnerReferences: getOwnerReferences(pod),
+			Labels:          pod.Labels,
+		},
+		Type: apiv1.SecretTypeOpaque,
+		Data: getArtifacts(runConfig),
+	}
+}
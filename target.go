@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// TargetConfig defines where the builder or chaincode pods run. By default, they run in the namespace of the peer.
+// Objects in another namespace or cluster cannot be owned by the peer pod, they are linked to it by labels.
+type TargetConfig struct {
+	Namespace     string            `yaml:"namespace"`      // namespace of the pods
+	Kubernetes    *KubernetesConfig `yaml:"kubernetes"`     // connection to another cluster, e.g. a kubeconfig
+	TransferClaim string            `yaml:"transfer_claim"` // claim in the namespace, which provides the transfer volume
+}
+
+// ForBuilder returns the configuration to create the builder pods in their namespace and cluster
+func (cfg Config) ForBuilder() (Config, error) {
+	cfg, err := cfg.forTarget(cfg.Builder.TargetConfig)
+	return cfg, errors.Wrap(err, "builder")
+}
+
+// ForLauncher returns the configuration to create the chaincode pods in their namespace and cluster
+func (cfg Config) ForLauncher() (Config, error) {
+	cfg, err := cfg.forTarget(cfg.Launcher.TargetConfig)
+	return cfg, errors.Wrap(err, "launcher")
+}
+
+// forTarget returns the configuration with the connection, namespace and transfer claim of the target
+func (cfg Config) forTarget(t TargetConfig) (Config, error) {
+	if t.Kubernetes != nil {
+		cfg.Kubernetes = *t.Kubernetes
+		namespace, err := getNamespace(cfg.Kubernetes)
+		if err != nil {
+			return cfg, err
+		}
+		cfg.Namespace = namespace
+	}
+	if t.Namespace != "" {
+		cfg.Namespace = t.Namespace
+	}
+
+	if t.TransferClaim != "" {
+		cfg.TransferVolume.Claim = t.TransferClaim
+	}
+
+	// The claim of the peer is not available in other namespaces
+	if !cfg.isPeerTarget() && t.TransferClaim == "" && cfg.Transfer.Mode != TransferModeExec {
+		return cfg, fmt.Errorf("pods in namespace %q require a transfer_claim or the transfer mode %s", cfg.Namespace, TransferModeExec)
+	}
+
+	return cfg, nil
+}
+
+// forPeer returns the configuration to access the namespace and cluster of the peer
+func (cfg Config) forPeer() Config {
+	cfg.Kubernetes = cfg.PeerKubernetes
+	cfg.Namespace = cfg.PeerNamespace
+
+	return cfg
+}
+
+// isPeerTarget returns true, if objects are created in the namespace and cluster of the peer
+func (cfg Config) isPeerTarget() bool {
+	return cfg.Namespace == cfg.PeerNamespace &&
+		cfg.Kubernetes.Kubeconfig == cfg.PeerKubernetes.Kubeconfig &&
+		cfg.Kubernetes.Context == cfg.PeerKubernetes.Context
+}
+
+// getTargets returns the configurations of the distinct namespaces and clusters, which contain objects of k8scc
+func (cfg Config) getTargets() ([]Config, error) {
+	targets := []Config{cfg.forPeer()}
+	for _, forTarget := range []func() (Config, error){cfg.ForBuilder, cfg.ForLauncher} {
+		target, err := forTarget()
+		if err != nil {
+			return nil, err
+		}
+
+		known := false
+		for _, t := range targets {
+			if t.Namespace == target.Namespace && t.Kubernetes.Kubeconfig == target.Kubernetes.Kubeconfig &&
+				t.Kubernetes.Context == target.Kubernetes.Context {
+				known = true
+			}
+		}
+		if !known {
+			targets = append(targets, target)
+		}
+	}
+
+	return targets, nil
+}
+
+// getPeerOwnerReferences returns the references to the peer pod, if the objects are created in its namespace.
+// Objects in other namespaces or clusters are linked to the peer by their labels, see ChaincodeInfo.
+func getPeerOwnerReferences(cfg Config, peer *apiv1.Pod) []metav1.OwnerReference {
+	if !cfg.isPeerTarget() {
+		return nil
+	}
+
+	return getOwnerReferences(peer)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/pkg/errors"
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/strategicpatch"
+)
+
+// PodTemplate is a partial Pod, which is merged into the generated builder or chaincode pod
+// using a strategic merge patch. This allows to set any field of the Pod, e.g.
+// nodeSelector, tolerations, securityContext or additional env variables of a container.
+type PodTemplate map[string]interface{}
+
+// applyPodTemplate merges the template into the pod
+func applyPodTemplate(template PodTemplate, pod *apiv1.Pod) error {
+	if len(template) == 0 {
+		return nil
+	}
+
+	patch, err := json.Marshal(normalizeYAML(map[string]interface{}(template)))
+	if err != nil {
+		return errors.Wrap(err, "marshaling pod template")
+	}
+
+	original, err := json.Marshal(pod)
+	if err != nil {
+		return errors.Wrap(err, "marshaling pod")
+	}
+
+	merged, err := strategicpatch.StrategicMergePatch(original, patch, apiv1.Pod{})
+	if err != nil {
+		return errors.Wrap(err, "merging pod template")
+	}
+
+	result := apiv1.Pod{}
+	err = json.Unmarshal(merged, &result)
+	if err != nil {
+		return errors.Wrap(err, "unmarshaling merged pod")
+	}
+
+	*pod = result
+	return nil
+}
+
+// applyPodTemplateSpec merges the template into the pod template of a workload like a Deployment
+func applyPodTemplateSpec(template PodTemplate, spec *apiv1.PodTemplateSpec) error {
+	pod := &apiv1.Pod{ObjectMeta: spec.ObjectMeta, Spec: spec.Spec}
+	err := applyPodTemplate(template, pod)
+	if err != nil {
+		return err
+	}
+
+	spec.ObjectMeta = pod.ObjectMeta
+	spec.Spec = pod.Spec
+	return nil
+}
+
+// normalizeYAML converts the map[interface{}]interface{} created by yaml.v2 into
+// map[string]interface{}, which can be marshaled to JSON
+func normalizeYAML(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, value := range v {
+			m[fmt.Sprintf("%v", key)] = normalizeYAML(value)
+		}
+		return m
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, value := range v {
+			m[key] = normalizeYAML(value)
+		}
+		return m
+	case []interface{}:
+		l := make([]interface{}, len(v))
+		for i, value := range v {
+			l[i] = normalizeYAML(value)
+		}
+		return l
+	default:
+		return v
+	}
+}
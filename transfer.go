@@ -0,0 +1,390 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/remotecommand"
+)
+
+const (
+	// TransferModePV exchanges data with the builder and chaincode pods using a shared PersistentVolume
+	TransferModePV = "pv"
+	// TransferModeExec exchanges data with the builder and chaincode pods using tar over pods/exec
+	TransferModeExec = "exec"
+
+	transferContainerName = "transfer"
+	transferVolumeName    = "transfer-pv"
+	transferControlDir    = "/k8scc/"
+	transferReadyFile     = transferControlDir + "ready"
+	transferExitCodeFile  = transferControlDir + "exitcode"
+	transferFetchedFile   = transferControlDir + "fetched"
+)
+
+// useExecTransfer replaces the transfer PV of the pod with an emptyDir volume. An init container
+// delays the start of the pod until the data has been copied into the volume using exec.
+// With awaitFetch, the pod doesn't terminate before the output of the container has been fetched.
+func useExecTransfer(cfg Config, spec *apiv1.PodSpec, awaitFetch bool) {
+	for i := range spec.Volumes {
+		if spec.Volumes[i].Name == transferVolumeName {
+			spec.Volumes[i].VolumeSource = apiv1.VolumeSource{EmptyDir: &apiv1.EmptyDirVolumeSource{}}
+		}
+	}
+
+	container := &spec.Containers[0]
+	controlMount := apiv1.VolumeMount{
+		Name:      transferVolumeName,
+		MountPath: transferControlDir,
+		SubPath:   "control",
+	}
+
+	// The init container mounts the same directories writeable
+	initMounts := []apiv1.VolumeMount{controlMount}
+	for _, m := range container.VolumeMounts {
+		if m.Name != transferVolumeName {
+			continue
+		}
+		m.ReadOnly = false
+		initMounts = append(initMounts, m)
+	}
+
+	image := cfg.Transfer.Image
+	if image == "" {
+		image = container.Image
+	}
+
+	spec.InitContainers = append(spec.InitContainers, apiv1.Container{
+		Name:            transferContainerName,
+		Image:           image,
+		ImagePullPolicy: apiv1.PullIfNotPresent,
+		Command: []string{
+			"/bin/sh", "-c", fmt.Sprintf("while [ ! -f %s ]; do sleep 1; done", transferReadyFile),
+		},
+		VolumeMounts: initMounts,
+	})
+
+	if awaitFetch {
+		script := fmt.Sprintf(`"$@"; rc=$?; echo $rc > %s; while [ ! -f %s ]; do sleep 1; done; exit $rc`,
+			transferExitCodeFile, transferFetchedFile)
+		container.Command = append([]string{"/bin/sh", "-c", script, "k8scc"}, container.Command...)
+		container.VolumeMounts = append(container.VolumeMounts, controlMount)
+	}
+}
+
+// watchPodInBackground watches the pod until completion, while data is transferred using exec
+func watchPodInBackground(ctx context.Context, cfg Config, pod *apiv1.Pod) <-chan error {
+	watched := make(chan error, 1)
+	go func() {
+		watched <- watchPodUntilCompletion(ctx, cfg, pod)
+	}()
+
+	return watched
+}
+
+// copyToPod copies the content of the local directory srcDir into destDir of the container
+func copyToPod(ctx context.Context, cfg Config, pod *apiv1.Pod, container, srcDir, destDir string) error {
+	reader, writer := io.Pipe()
+	go func() {
+		err := tarDirectory(srcDir, writer)
+		_ = writer.CloseWithError(err)
+	}()
+
+	err := execInPod(ctx, cfg, pod, container, []string{"tar", "-xf", "-", "-C", destDir}, reader, nil)
+	_ = reader.Close()
+
+	return errors.Wrapf(err, "copying %s to %s in pod %s", srcDir, destDir, pod.Name)
+}
+
+// copyFromPod copies the content of srcDir in the container into the local directory destDir
+func copyFromPod(ctx context.Context, cfg Config, pod *apiv1.Pod, container, srcDir, destDir string) error {
+	reader, writer := io.Pipe()
+	result := make(chan error, 1)
+	go func() {
+		err := untarDirectory(reader, destDir)
+		_ = reader.CloseWithError(err)
+		result <- err
+	}()
+
+	err := execInPod(ctx, cfg, pod, container, []string{"tar", "-cf", "-", "-C", srcDir, "."}, nil, writer)
+	_ = writer.CloseWithError(err)
+	if err != nil {
+		return errors.Wrapf(err, "copying %s from pod %s", srcDir, pod.Name)
+	}
+
+	return errors.Wrapf(<-result, "extracting %s from pod %s", srcDir, pod.Name)
+}
+
+// touchInPod creates an empty file in the container, e.g. to signal the end of a transfer
+func touchInPod(ctx context.Context, cfg Config, pod *apiv1.Pod, container, file string) error {
+	err := execInPod(ctx, cfg, pod, container, []string{"touch", file}, nil, nil)
+	return errors.Wrapf(err, "creating %s in pod %s", file, pod.Name)
+}
+
+// waitForExitCode waits until the command of a container started by useExecTransfer with
+// awaitFetch has finished and returns its exit code
+func waitForExitCode(ctx context.Context, cfg Config, pod *apiv1.Pod, container string) (string, error) {
+	script := fmt.Sprintf("while [ ! -f %[1]s ]; do sleep 1; done; cat %[1]s", transferExitCodeFile)
+	stdout := &bytes.Buffer{}
+
+	err := execInPod(ctx, cfg, pod, container, []string{"/bin/sh", "-c", script}, nil, stdout)
+	if err != nil {
+		return "", errors.Wrapf(err, "waiting for exit code in pod %s", pod.Name)
+	}
+
+	return strings.TrimSpace(stdout.String()), nil
+}
+
+func execInPod(ctx context.Context, cfg Config, pod *apiv1.Pod, container string,
+	command []string, stdin io.Reader, stdout io.Writer) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	// Setup kubernetes client
+	config, err := getKubernetesConfig(cfg)
+	if err != nil {
+		return errors.Wrap(err, "getting kubernetes config")
+	}
+
+	clientset, err := getKubernetesClientset(cfg)
+	if err != nil {
+		return errors.Wrap(err, "getting kubernetes clientset")
+	}
+
+	req := clientset.CoreV1().RESTClient().Post().
+		Resource("pods").
+		Namespace(pod.Namespace).
+		Name(pod.Name).
+		SubResource("exec").
+		VersionedParams(&apiv1.PodExecOptions{
+			Container: container,
+			Command:   command,
+			Stdin:     stdin != nil,
+			Stdout:    stdout != nil,
+			Stderr:    true,
+		}, scheme.ParameterCodec)
+
+	executor, err := remotecommand.NewSPDYExecutor(config, "POST", req.URL())
+	if err != nil {
+		return errors.Wrap(err, "creating executor")
+	}
+
+	// The stream cannot be cancelled, it ends when the pod gets deleted
+	stderr := &bytes.Buffer{}
+	streamed := make(chan error, 1)
+	go func() {
+		streamed <- executor.Stream(remotecommand.StreamOptions{
+			Stdin:  stdin,
+			Stdout: stdout,
+			Stderr: stderr,
+		})
+	}()
+
+	select {
+	case err = <-streamed:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	return errors.Wrapf(err, "executing %q: %s", strings.Join(command, " "), strings.TrimSpace(stderr.String()))
+}
+
+// waitForContainerRunning waits until the (init) container of the pod is running
+func waitForContainerRunning(ctx context.Context, cfg Config, pod *apiv1.Pod, container string) error {
+	// Setup kubernetes client
+	clientset, err := getKubernetesClientset(cfg)
+	if err != nil {
+		return errors.Wrap(err, "getting kubernetes clientset")
+	}
+
+	for {
+		p, err := clientset.CoreV1().Pods(pod.Namespace).Get(ctx, pod.Name, metav1.GetOptions{})
+		if err != nil {
+			return errors.Wrap(err, "getting pod")
+		}
+
+		if p.Status.Phase == apiv1.PodSucceeded || p.Status.Phase == apiv1.PodFailed {
+			return fmt.Errorf("pod %s terminated: %s", p.Name, describePodFailure(p))
+		}
+
+		if err := getFatalPodState(p, cfg.Timeouts.Unschedulable); err != nil {
+			return errors.Wrapf(err, "pod %s", p.Name)
+		}
+
+		statuses := append(p.Status.InitContainerStatuses, p.Status.ContainerStatuses...)
+		for _, s := range statuses {
+			if s.Name != container {
+				continue
+			}
+			if s.State.Running != nil {
+				return nil
+			}
+			if s.State.Terminated != nil {
+				return fmt.Errorf("container %s in pod %s terminated", container, p.Name)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// tarDirectory writes the content of dir as tar stream to w
+func tarDirectory(dir string, w io.Writer) error {
+	tw := tar.NewWriter(w)
+
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(dir, path)
+		if err != nil || rel == "." {
+			return err
+		}
+
+		link := ""
+		if info.Mode()&os.ModeSymlink != 0 {
+			link, err = os.Readlink(path)
+			if err != nil {
+				return err
+			}
+		}
+
+		hdr, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(rel)
+
+		err = tw.WriteHeader(hdr)
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+
+		f, err := os.Open(path) // #nosec G304
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return errors.Wrapf(err, "creating tar stream of %s", dir)
+	}
+
+	return tw.Close()
+}
+
+// untarDirectory extracts the tar stream r into dir. The stream comes from a pod or a chaincode package,
+// so entries and symbolic links, which point outside of dir, are rejected.
+func untarDirectory(r io.Reader, dir string) error {
+	tr := tar.NewReader(r)
+	dir = filepath.Clean(dir)
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		path := filepath.Join(dir, filepath.FromSlash(hdr.Name)) // #nosec G305
+		if !isWithinDir(dir, path) {
+			return fmt.Errorf("invalid path %q in tar stream", hdr.Name)
+		}
+
+		// A symbolic link extracted before must not redirect this entry
+		err = checkNoSymlinks(dir, path)
+		if err != nil {
+			return errors.Wrapf(err, "extracting %s", hdr.Name)
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(path, os.FileMode(hdr.Mode)|0700)
+		case tar.TypeSymlink:
+			target := filepath.FromSlash(hdr.Linkname)
+			if filepath.IsAbs(target) || !isWithinDir(dir, filepath.Join(filepath.Dir(path), target)) {
+				return fmt.Errorf("invalid symbolic link %q -> %q in tar stream", hdr.Name, hdr.Linkname)
+			}
+			err = os.Symlink(hdr.Linkname, path)
+		case tar.TypeReg:
+			err = writeFileFromTar(tr, path, os.FileMode(hdr.Mode))
+		default:
+			log.Printf("Skipping %q of unsupported type %c in tar stream", hdr.Name, hdr.Typeflag)
+		}
+		if err != nil {
+			return errors.Wrapf(err, "extracting %s", hdr.Name)
+		}
+	}
+}
+
+// isWithinDir returns true, if the cleaned path is dir or below dir
+func isWithinDir(dir, path string) bool {
+	path = filepath.Clean(path)
+	return path == dir || strings.HasPrefix(path, dir+string(os.PathSeparator))
+}
+
+// checkNoSymlinks returns an error, if path or one of its parents below dir is a symbolic link
+func checkNoSymlinks(dir, path string) error {
+	rel, err := filepath.Rel(dir, path)
+	if err != nil {
+		return err
+	}
+	if rel == "." {
+		return nil
+	}
+
+	current := dir
+	for _, part := range strings.Split(rel, string(os.PathSeparator)) {
+		current = filepath.Join(current, part)
+		info, err := os.Lstat(current)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("%s is a symbolic link", current)
+		}
+	}
+
+	return nil
+}
+
+func writeFileFromTar(r io.Reader, path string, mode os.FileMode) error {
+	err := os.MkdirAll(filepath.Dir(path), os.ModePerm)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, mode) // #nosec G304
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(f, r) // #nosec G110
+	return err
+}
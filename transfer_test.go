@@ -0,0 +1,140 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// tarEntry is an entry of a tar stream created by the tests
+type tarEntry struct {
+	name     string
+	typeflag byte
+	linkname string
+	content  string
+}
+
+func newTarStream(t *testing.T, entries []tarEntry) *bytes.Buffer {
+	t.Helper()
+
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e.name, Typeflag: e.typeflag, Linkname: e.linkname, Mode: 0644, Size: int64(len(e.content))}
+		if e.typeflag == tar.TypeDir {
+			hdr.Mode = 0755
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e.content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf
+}
+
+func TestUntarDirectory(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []tarEntry
+		wantErr bool
+		files   map[string]string // files expected below the directory
+	}{
+		{
+			name: "files and directories",
+			entries: []tarEntry{
+				{name: "bin/", typeflag: tar.TypeDir},
+				{name: "bin/chaincode", typeflag: tar.TypeReg, content: "binary"},
+				{name: "META-INF/statedb.json", typeflag: tar.TypeReg, content: "{}"},
+			},
+			files: map[string]string{"bin/chaincode": "binary", "META-INF/statedb.json": "{}"},
+		},
+		{
+			name: "relative symbolic link within the directory",
+			entries: []tarEntry{
+				{name: "bin/chaincode", typeflag: tar.TypeReg, content: "binary"},
+				{name: "chaincode", typeflag: tar.TypeSymlink, linkname: "bin/chaincode"},
+			},
+			files: map[string]string{"chaincode": "binary"},
+		},
+		{
+			name:    "path outside of the directory",
+			entries: []tarEntry{{name: "../evil", typeflag: tar.TypeReg, content: "x"}},
+			wantErr: true,
+		},
+		{
+			name:    "absolute symbolic link",
+			entries: []tarEntry{{name: "out", typeflag: tar.TypeSymlink, linkname: "/etc"}},
+			wantErr: true,
+		},
+		{
+			name:    "relative symbolic link outside of the directory",
+			entries: []tarEntry{{name: "bin/out", typeflag: tar.TypeSymlink, linkname: "../../etc"}},
+			wantErr: true,
+		},
+		{
+			name: "entry below a symbolic link",
+			entries: []tarEntry{
+				{name: "sub/", typeflag: tar.TypeDir},
+				{name: "out", typeflag: tar.TypeSymlink, linkname: "sub"},
+				{name: "out/x", typeflag: tar.TypeReg, content: "x"},
+			},
+			wantErr: true,
+		},
+		{
+			name: "file replacing a symbolic link",
+			entries: []tarEntry{
+				{name: "target", typeflag: tar.TypeReg, content: "original"},
+				{name: "link", typeflag: tar.TypeSymlink, linkname: "target"},
+				{name: "link", typeflag: tar.TypeReg, content: "overwritten"},
+			},
+			wantErr: true,
+			files:   map[string]string{"target": "original"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parent, err := ioutil.TempDir("", "k8scc-test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(parent)
+			dir := filepath.Join(parent, "output")
+
+			err = untarDirectory(newTarStream(t, tt.entries), dir)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("untarDirectory() error = %v, want error %t", err, tt.wantErr)
+			}
+
+			for name, want := range tt.files {
+				data, err := ioutil.ReadFile(filepath.Join(dir, name))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(data) != want {
+					t.Errorf("content of %s = %q, want %q", name, data, want)
+				}
+			}
+
+			// Nothing may be written next to the directory
+			files, err := ioutil.ReadDir(parent)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, f := range files {
+				if f.Name() != "output" {
+					t.Errorf("unexpected file %s outside of the directory", f.Name())
+				}
+			}
+		})
+	}
+}